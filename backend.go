@@ -0,0 +1,160 @@
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// The git operations that mirroring needs, so that they can be done
+// by libgit2 (git2go), by a pure-Go git (go-git) or by running the git
+// binary.
+//
+// Branches are named the way the local mirror branches are, for
+// both kinds (fedora/f31 for refs/heads/fedora/f31 and for
+// refs/remotes/fedora/f31).  Commits are hex object ids.
+type repository interface {
+	// Free the repo, it can't be used afterwards.
+	Free()
+	// Open another handle of the same repo, for an operation that
+	// may be abandoned (see runContext).
+	Reopen() (repository, error)
+	IsBare() bool
+
+	// The names of the remotes.
+	Remotes() ([]string, error)
+	// The URL of a remote, errNotFound if there is no such remote.
+	RemoteURL(name string) (string, error)
+	CreateRemote(name string, url string) error
+	SetRemoteURL(name string, url string) error
+	FetchRefspecs(name string) ([]string, error)
+	AddFetchRefspec(name string, refspec string) error
+	// Turn off the auto-following of tags (tagopt = --no-tags).
+	SetNoTags(name string) error
+	// Prune the remote-tracking refs that are gone (fetch.prune).
+	SetFetchPrune(prune bool) error
+	FetchPrune() (bool, error)
+	Fetch(ctx context.Context, name string, opts fetchOptions) error
+	// The branches of a remote (f31 for refs/heads/f31), without
+	// fetching.
+	RemoteBranches(ctx context.Context, name string, opts fetchOptions) ([]string, error)
+	// Connect to a URL to check that it answers, without fetching.
+	Probe(ctx context.Context, url string, opts fetchOptions) error
+
+	Branches(kind branchKind) ([]string, error)
+	// The commit of a branch, errNotFound if there is no such branch.
+	BranchTarget(name string, kind branchKind) (string, error)
+	CreateBranch(name string, target string) error
+	// Delete a local branch along with its upstream config.
+	DeleteBranch(name string) error
+	IsHead(name string) (bool, error)
+	// Move a local branch.  Only the checked out branch touches the
+	// worktree and then only with a safe checkout, so local edits are
+	// never discarded.  If that can't be done the branch isn't moved.
+	UpdateBranch(name string, target string, msg string) error
+	// The upstream of a local branch (branch.<name>.remote/merge),
+	// both are "" if it doesn't have one.
+	Upstream(name string) (string, string, error)
+	SetUpstream(name string, remote string, merge string) error
+
+	// The commit of a ref, errNotFound if there is no such ref.
+	RefTarget(name string) (string, error)
+	CreateRef(name string, target string, force bool, msg string) error
+	// Delete a ref, a symbolic one itself and not what it points to.
+	DeleteRef(name string) error
+	// What a symbolic ref points to, "" if it isn't a symbolic ref
+	// or errNotFound if there is no such ref.
+	SymbolicRef(name string) (string, error)
+	CreateSymbolicRef(name string, target string, msg string) error
+	// Whether commit has ancestor in its history.
+	DescendantOf(commit string, ancestor string) (bool, error)
+	// The contents of a file in a commit, errNotFound if the commit
+	// doesn't have it.
+	ReadFile(commit string, path string) ([]byte, error)
+}
+
+type backend interface {
+	Open(path string) (repository, error)
+	// Clone url in to path.  Like a fetch it may be abandoned, so it
+	// must not keep anything open when it returns.
+	Clone(ctx context.Context, url string, path string, bare bool, opts fetchOptions) error
+}
+
+type branchKind int
+
+const (
+	localBranch branchKind = iota
+	remoteBranch
+)
+
+// What a fetch (or clone, or probe) needs to know about the remote.
+type fetchOptions struct {
+	remote      string
+	credentials *CredentialsConfig
+	// what a fetch gets instead of the refspecs of the remote, if
+	// there are any
+	refspecs []string
+	// nil if nobody wants the progress
+	progress func(FetchProgress)
+}
+
+// The fetch options for a remote of a run.
+func newFetchOptions(rc *RemoteConfig, run *mirrorRun) fetchOptions {
+	opts := fetchOptions{
+		remote:      rc.Name,
+		credentials: rc.Credentials,
+	}
+	if run != nil && run.opts.FetchProgress != nil {
+		opts.progress = run.opts.FetchProgress
+	}
+
+	return opts
+}
+
+// A remote, branch or ref that doesn't exist.
+var errNotFound = errors.New("not found")
+
+// The backend used when the config doesn't name one: $RGM_BACKEND if
+// it is set, else libgit2 unless it was left out (see libgit2Backend),
+// else go-git.
+func DefaultBackend() string {
+	if name := os.Getenv("RGM_BACKEND"); name != "" {
+		return name
+	}
+	if _, ok := backends["libgit2"]; ok {
+		return "libgit2"
+	}
+
+	return "go-git"
+}
+
+var backends = map[string]backend{
+	"go-git": gogitBackend{},
+	"exec":   execBackend{},
+}
+
+// The names of the available backends.
+func Backends() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func getBackend(name string) (backend, error) {
+	if name == "" {
+		name = DefaultBackend()
+	}
+
+	be, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend '%s'", name)
+	}
+
+	return be, nil
+}
@@ -0,0 +1,722 @@
+package rgm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The backend that runs the git binary, so the transport (protocol
+// v2, credential helpers, ~/.ssh/config, ...) is exactly what git
+// does.  Nothing is kept open, each operation is a git command.
+type execBackend struct{}
+
+// The git binary, from $PATH by default.
+var gitBinary = "git"
+
+func (execBackend) Open(path string) (repository, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &execRepo{path: abs}
+	out, err := r.git("rev-parse", "--is-bare-repository", "--absolute-git-dir")
+	if err != nil {
+		return nil, err
+	}
+	info := lines(out)
+	if len(info) != 2 {
+		return nil, fmt.Errorf("unexpected output of git rev-parse: %s", out)
+	}
+	r.bare = info[0] == "true"
+	r.git_dir = info[1]
+
+	return r, nil
+}
+
+func (execBackend) Clone(ctx context.Context, url string, path string, bare bool, opts fetchOptions) error {
+	args := []string{"clone", "--progress"}
+	if bare {
+		args = append(args, "--bare")
+	}
+	args = append(args, "--", url, path)
+
+	_, err := runGitTransfer(ctx, "", url, opts, args...)
+	return err
+}
+
+type execRepo struct {
+	path    string
+	git_dir string
+	bare    bool
+}
+
+// A git command that failed, with what it printed on stderr.
+type execError struct {
+	args   []string
+	stderr string
+	err    error
+}
+
+func (e *execError) Error() string {
+	msg := strings.TrimSpace(e.stderr)
+	if msg == "" {
+		msg = e.err.Error()
+	}
+
+	return fmt.Sprintf("git %s: %s", e.args[0], msg)
+}
+
+func (e *execError) Unwrap() error {
+	return e.err
+}
+
+// The exit code of a git command that ran but failed, -1 otherwise.
+func exitCode(err error) int {
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) {
+		return exit_err.ExitCode()
+	}
+
+	return -1
+}
+
+// The environment of every git command: no prompts, messages that
+// can be parsed and no looking for a repo above the one given.
+func gitEnv(dir string) []string {
+	env := append(os.Environ(), "LC_ALL=C", "GIT_TERMINAL_PROMPT=0")
+	if dir != "" {
+		env = append(env, "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+	}
+
+	return env
+}
+
+// Run a git command in the repo and return its output, trimmed.
+func (r *execRepo) git(args ...string) (string, error) {
+	cmd := exec.Command(gitBinary, append([]string{"-C", r.path}, args...)...)
+	cmd.Env = gitEnv(r.path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", &execError{args: args, stderr: stderr.String(), err: err}
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Like git but a missing value (exit code 1, e.g. of git config
+// --get) is errNotFound.
+func (r *execRepo) gitLookup(args ...string) (string, error) {
+	out, err := r.git(args...)
+	if exitCode(err) == 1 {
+		return "", fmt.Errorf("%w: %v", errNotFound, err)
+	}
+
+	return out, err
+}
+
+func lines(out string) []string {
+	if out == "" {
+		return nil
+	}
+
+	return strings.Split(out, "\n")
+}
+
+// Matches the progress git prints with --progress, e.g.
+//
+//	Receiving objects:  45% (139/310), 1.20 MiB | 2.40 MiB/s
+//	Unpacking objects: 100% (10/10), 1.02 KiB | 1.02 MiB/s, done.
+//
+// (small fetches are unpacked instead of being kept as a pack)
+var progressRe = regexp.MustCompile(`^(?:Receiving|Unpacking) objects: +\d+% \((\d+)/(\d+)\)(?:, ([\d.]+) (bytes|KiB|MiB|GiB))?`)
+
+// The number of objects the remote is sending, it may be all there
+// is when the pack is too small for the progress to be shown.
+//
+//	remote: Total 11 (delta 0), reused 0 (delta 0), pack-reused 0
+var totalRe = regexp.MustCompile(`^remote: Total (\d+)`)
+
+var byteUnits = map[string]float64{
+	"bytes": 1,
+	"KiB":   1 << 10,
+	"MiB":   1 << 20,
+	"GiB":   1 << 30,
+}
+
+// Parse a progress line of git, ok is false if it isn't one.  git
+// indexes the objects as they are received.
+func parseProgress(line string) (FetchProgress, bool) {
+	match := progressRe.FindStringSubmatch(line)
+	if match == nil {
+		return FetchProgress{}, false
+	}
+
+	received, _ := strconv.ParseUint(match[1], 10, 0)
+	total, _ := strconv.ParseUint(match[2], 10, 0)
+	prog := FetchProgress{
+		TotalObjects:    uint(total),
+		ReceivedObjects: uint(received),
+		IndexedObjects:  uint(received),
+	}
+	if match[3] != "" {
+		size, _ := strconv.ParseFloat(match[3], 64)
+		prog.ReceivedBytes = uint(size * byteUnits[match[4]])
+	}
+
+	return prog, true
+}
+
+// Split on the \r git ends progress updates with as well as on \n.
+func scanProgressLines(data []byte, at_eof bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if at_eof && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// Single quote a word for the shell.
+func shellQuote(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// Hands out the login in $RGM_GIT_USERNAME and $RGM_GIT_PASSWORD, so
+// that the password never shows up in the arguments.
+const credentialHelper = `!f() { test "$1" = get && echo "username=$RGM_GIT_USERNAME" && echo "password=$RGM_GIT_PASSWORD"; }; f`
+
+// The git options and environment for the credentials of a URL.
+func execAuth(remote_url string, cc *CredentialsConfig) ([]string, []string, error) {
+	if cc == nil {
+		return nil, nil, nil
+	}
+
+	u, err := url.Parse(remote_url)
+	if err != nil || u.Scheme == "" || u.Scheme == "ssh" || u.Scheme == "git+ssh" {
+		// ssh://host/path, host:path or a local path
+		if !cc.SSHAgent && cc.SSHKey == "" {
+			return nil, nil, nil
+		}
+		if cc.SSHPassphraseEnv != "" {
+			return nil, nil, fmt.Errorf("the git binary can't be given an SSH passphrase, use the ssh-agent")
+		}
+		ssh := "ssh -o BatchMode=yes"
+		if cc.Username != "" {
+			ssh += " -l " + shellQuote(cc.Username)
+		}
+		if !cc.SSHAgent {
+			ssh += " -o IdentitiesOnly=yes -i " + shellQuote(expandHome(cc.SSHKey))
+		}
+		return nil, []string{"GIT_SSH_COMMAND=" + ssh}, nil
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil, nil
+	}
+	if cc.PasswordEnv == "" && !cc.Netrc {
+		return nil, nil, nil
+	}
+
+	username := cc.Username
+	if username == "" && u.User != nil {
+		username = u.User.Username()
+	}
+	user, password, err := cc.userpass(remote_url, username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the empty helper drops the ones from the user's config
+	args := []string{"-c", "credential.helper=", "-c", "credential.helper=" + credentialHelper}
+	env := []string{"RGM_GIT_USERNAME=" + user, "RGM_GIT_PASSWORD=" + password}
+
+	return args, env, nil
+}
+
+// Run a git command that talks to a remote (clone, fetch, ...) on the
+// repo in git_dir (none if it's ""), passing the progress on, and
+// return its output.  It is killed, along with what it runs, if the
+// context is done.
+//
+// It runs in the current directory, not the repo, so that relative
+// URLs are found the same way as with the other backends.
+func runGitTransfer(ctx context.Context, git_dir string, url string, opts fetchOptions, args ...string) (string, error) {
+	auth_args, auth_env, err := execAuth(url, opts.credentials)
+	if err != nil {
+		return "", err
+	}
+
+	var full []string
+	if git_dir != "" {
+		full = append(full, "--git-dir="+git_dir)
+	}
+	full = append(full, auth_args...)
+	full = append(full, args...)
+
+	cmd := exec.CommandContext(ctx, gitBinary, full...)
+	killProcessGroup(cmd)
+	cmd.Env = append(gitEnv(""), auth_env...)
+	var out strings.Builder
+	cmd.Stdout = &out
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	// keep the messages, not the progress, for the error
+	var msgs strings.Builder
+	var last FetchProgress
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if prog, ok := parseProgress(line); ok {
+			prog.Remote = opts.remote
+			last = prog
+			if opts.progress != nil {
+				opts.progress(prog)
+			}
+			continue
+		}
+		if match := totalRe.FindStringSubmatch(line); match != nil {
+			total, _ := strconv.ParseUint(match[1], 10, 0)
+			last.TotalObjects = uint(total)
+			continue
+		}
+		if line != "" && !strings.Contains(line, "% (") {
+			msgs.WriteString(line + "\n")
+		}
+	}
+	io.Copy(io.Discard, stderr)
+
+	err = cmd.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("git %s: %w", args[0], ctx.Err())
+		}
+		return "", &execError{args: args, stderr: msgs.String(), err: err}
+	}
+
+	// nothing may have been received, e.g. when it's up-to-date
+	if opts.progress != nil && !last.Done() {
+		opts.progress(FetchProgress{
+			Remote:          opts.remote,
+			TotalObjects:    last.TotalObjects,
+			ReceivedObjects: last.TotalObjects,
+			IndexedObjects:  last.TotalObjects,
+			ReceivedBytes:   last.ReceivedBytes,
+		})
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// Matches the HTTP status of a failed request, e.g.
+//
+//	fatal: unable to access '...': The requested URL returned error: 502
+var execStatusRe = regexp.MustCompile(`returned error: (\d{3})`)
+
+var execPermanent = []string{
+	"Authentication failed",
+	"could not read Username",
+	"could not read Password",
+	"Permission denied",
+	"Host key verification failed",
+	"not found",
+	"does not appear to be a git repository",
+}
+
+var execTransient = []string{
+	"Could not resolve host",
+	"Failed to connect",
+	"Connection refused",
+	"Connection reset",
+	"Connection timed out",
+	"Operation timed out",
+	"RPC failed",
+	"early EOF",
+	"remote end hung up unexpectedly",
+}
+
+// Whether a failed git command is worth retrying, known is false if
+// it isn't an error from the git binary.
+func execRetryable(err error) (retryable bool, known bool) {
+	var exec_err *execError
+	if !errors.As(err, &exec_err) {
+		return false, false
+	}
+
+	match := execStatusRe.FindStringSubmatch(exec_err.stderr)
+	if match != nil {
+		status, _ := strconv.Atoi(match[1])
+		return status >= 500, true
+	}
+	for _, msg := range execPermanent {
+		if strings.Contains(exec_err.stderr, msg) {
+			return false, true
+		}
+	}
+	for _, msg := range execTransient {
+		if strings.Contains(exec_err.stderr, msg) {
+			return true, true
+		}
+	}
+
+	return false, true
+}
+
+func (r *execRepo) Free() {}
+
+func (r *execRepo) Reopen() (repository, error) {
+	handle := *r
+	return &handle, nil
+}
+
+func (r *execRepo) IsBare() bool {
+	return r.bare
+}
+
+func (r *execRepo) Remotes() ([]string, error) {
+	out, err := r.git("remote")
+	if err != nil {
+		return nil, err
+	}
+
+	return lines(out), nil
+}
+
+func (r *execRepo) RemoteURL(name string) (string, error) {
+	return r.gitLookup("config", "--get", "remote."+name+".url")
+}
+
+func (r *execRepo) CreateRemote(name string, url string) error {
+	_, err := r.git("remote", "add", "--", name, url)
+	return err
+}
+
+func (r *execRepo) SetRemoteURL(name string, url string) error {
+	_, err := r.git("remote", "set-url", "--", name, url)
+	return err
+}
+
+func (r *execRepo) FetchRefspecs(name string) ([]string, error) {
+	_, err := r.RemoteURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := r.gitLookup("config", "--get-all", "remote."+name+".fetch")
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+
+	return lines(out), err
+}
+
+func (r *execRepo) AddFetchRefspec(name string, refspec string) error {
+	_, err := r.git("config", "--add", "remote."+name+".fetch", refspec)
+	return err
+}
+
+func (r *execRepo) SetNoTags(name string) error {
+	_, err := r.git("config", "remote."+name+".tagopt", "--no-tags")
+	return err
+}
+
+func (r *execRepo) SetFetchPrune(prune bool) error {
+	_, err := r.git("config", "fetch.prune", strconv.FormatBool(prune))
+	return err
+}
+
+func (r *execRepo) FetchPrune() (bool, error) {
+	out, err := r.gitLookup("config", "--bool", "fetch.prune")
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return out == "true", nil
+}
+
+func (r *execRepo) Fetch(ctx context.Context, name string, opts fetchOptions) error {
+	url, err := r.RemoteURL(name)
+	if err != nil {
+		return fmt.Errorf("unable to find remote: %v", err)
+	}
+
+	args := append([]string{"fetch", "--progress", "--", name}, opts.refspecs...)
+	_, err = runGitTransfer(ctx, r.git_dir, url, opts, args...)
+	return err
+}
+
+func (r *execRepo) Probe(ctx context.Context, url string, opts fetchOptions) error {
+	_, err := runGitTransfer(ctx, r.git_dir, url, opts, "ls-remote", "--", url, "HEAD")
+	return err
+}
+
+func (r *execRepo) RemoteBranches(ctx context.Context, name string, opts fetchOptions) ([]string, error) {
+	url, err := r.RemoteURL(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find remote: %v", err)
+	}
+
+	// it isn't a transfer, there is no progress to report
+	opts.progress = nil
+	out, err := runGitTransfer(ctx, r.git_dir, url, opts, "ls-remote", "--heads", "--", name)
+	if err != nil {
+		return nil, err
+	}
+
+	//   <oid>  refs/heads/f31
+	var branches []string
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			branches = append(branches, strings.TrimPrefix(fields[1], "refs/heads/"))
+		}
+	}
+
+	return branches, nil
+}
+
+func execBranchRef(name string, kind branchKind) string {
+	if kind == remoteBranch {
+		return "refs/remotes/" + name
+	}
+
+	return "refs/heads/" + name
+}
+
+func (r *execRepo) Branches(kind branchKind) ([]string, error) {
+	prefix := execBranchRef("", kind)
+	out, err := r.git("for-each-ref", "--format=%(refname)", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []string
+	for _, ref := range lines(out) {
+		branches = append(branches, strings.TrimPrefix(ref, prefix))
+	}
+
+	return branches, nil
+}
+
+func (r *execRepo) BranchTarget(name string, kind branchKind) (string, error) {
+	return r.RefTarget(execBranchRef(name, kind))
+}
+
+func (r *execRepo) CreateBranch(name string, target string) error {
+	return r.CreateRef(execBranchRef(name, localBranch), target, false, "")
+}
+
+func (r *execRepo) DeleteBranch(name string) error {
+	_, err := r.BranchTarget(name, localBranch)
+	if err != nil {
+		return err
+	}
+
+	// this also removes the branch.<branch>.* tracking config
+	_, err = r.git("branch", "-D", "--", name)
+	return err
+}
+
+func (r *execRepo) IsHead(name string) (bool, error) {
+	_, err := r.BranchTarget(name, localBranch)
+	if err != nil {
+		return false, err
+	}
+
+	head, err := r.gitLookup("symbolic-ref", "-q", "HEAD")
+	if errors.Is(err, errNotFound) {
+		return false, nil // detached
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return head == execBranchRef(name, localBranch), nil
+}
+
+func (r *execRepo) UpdateBranch(name string, target string, msg string) error {
+	is_head, err := r.IsHead(name)
+	if err != nil {
+		return fmt.Errorf("unable to check if '%s' is HEAD: %v", name, err)
+	}
+
+	ref := execBranchRef(name, localBranch)
+	old, err := r.BranchTarget(name, localBranch)
+	if err != nil {
+		return err
+	}
+
+	// The ref is moved first so that a failed update leaves the
+	// worktree alone, and moved back if the checkout then fails.
+	_, err = r.git(updateRefArgs(msg, ref, target)...)
+	if err != nil {
+		return fmt.Errorf("Update of '%s' failed: %v", name, err)
+	}
+
+	if !is_head || r.bare {
+		return nil
+	}
+
+	// a two tree merge is what checkout does, it refuses to touch
+	// files with local changes
+	_, err = r.git("read-tree", "-m", "-u", old, target)
+	if err != nil {
+		_, back_err := r.git(updateRefArgs("pull: undo, checkout failed", ref, old)...)
+		if back_err != nil {
+			return fmt.Errorf("unable to checkout '%s' (%v) or to move it back: %v", name, err, back_err)
+		}
+		return fmt.Errorf("unable to checkout '%s', local changes?: %v", name, err)
+	}
+
+	return nil
+}
+
+func (r *execRepo) Upstream(name string) (string, string, error) {
+	remote, err := r.gitLookup("config", "--get", "branch."+name+".remote")
+	if errors.Is(err, errNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	merge, err := r.gitLookup("config", "--get", "branch."+name+".merge")
+	if errors.Is(err, errNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return remote, merge, nil
+}
+
+func (r *execRepo) SetUpstream(name string, remote string, merge string) error {
+	_, err := r.git("config", "branch."+name+".remote", remote)
+	if err != nil {
+		return fmt.Errorf("Failed to set config remote: %v", err)
+	}
+	_, err = r.git("config", "branch."+name+".merge", merge)
+	if err != nil {
+		return fmt.Errorf("Failed to set config merge: %v", err)
+	}
+
+	return nil
+}
+
+func (r *execRepo) RefTarget(name string) (string, error) {
+	return r.gitLookup("rev-parse", "--verify", "--quiet", name)
+}
+
+func (r *execRepo) CreateRef(name string, target string, force bool, msg string) error {
+	args := updateRefArgs(msg, name, target)
+	if !force {
+		// it mustn't exist yet
+		args = append(args, "")
+	}
+
+	_, err := r.git(args...)
+	return err
+}
+
+func (r *execRepo) DeleteRef(name string) error {
+	// a symbolic ref may point to nothing, so it can't be resolved
+	_, err := r.SymbolicRef(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.git("update-ref", "--no-deref", "-d", name)
+	return err
+}
+
+func (r *execRepo) SymbolicRef(name string) (string, error) {
+	out, err := r.git("symbolic-ref", "--quiet", name)
+	if err == nil {
+		return out, nil
+	}
+	if exitCode(err) != 1 {
+		return "", err
+	}
+
+	// it isn't a symbolic ref, if it is a ref at all
+	_, err = r.RefTarget(name)
+	return "", err
+}
+
+func (r *execRepo) CreateSymbolicRef(name string, target string, msg string) error {
+	args := []string{"symbolic-ref", name, target}
+	if msg != "" {
+		args = []string{"symbolic-ref", "-m", msg, name, target}
+	}
+
+	_, err := r.git(args...)
+	return err
+}
+
+// git update-ref refuses an empty message.
+func updateRefArgs(msg string, name string, target string) []string {
+	if msg == "" {
+		return []string{"update-ref", name, target}
+	}
+
+	return []string{"update-ref", "-m", msg, name, target}
+}
+
+func (r *execRepo) DescendantOf(commit string, ancestor string) (bool, error) {
+	if commit == ancestor {
+		return false, nil
+	}
+
+	_, err := r.git("merge-base", "--is-ancestor", ancestor, commit)
+	if exitCode(err) == 1 {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *execRepo) ReadFile(commit string, path string) ([]byte, error) {
+	object := commit + ":" + path
+	_, err := r.gitLookup("rev-parse", "--verify", "--quiet", object)
+	if err != nil {
+		return nil, err
+	}
+
+	// not r.git, the contents are as they are
+	cmd := exec.Command(gitBinary, "-C", r.path, "cat-file", "blob", object)
+	cmd.Env = gitEnv(r.path)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, &execError{args: cmd.Args[3:], err: err}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package rgm
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run git in a process group of its own and kill all of it when the
+// context is done.  Killing only git would leave what it runs (e.g.
+// git-remote-https and the fetch-pack under it) fetching in to the
+// repo, and holding on to the stderr that is read until it closes.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,9 @@
+package rgm
+
+import (
+	"os/exec"
+)
+
+// There are no process groups to kill, only git itself is killed when
+// the context is done.
+func killProcessGroup(cmd *exec.Cmd) {}
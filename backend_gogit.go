@@ -0,0 +1,741 @@
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The backend on go-git, a git in pure Go so no libgit2 (or cgo) is
+// needed.
+//
+// go-git doesn't report how many objects were received so there is
+// no FetchProgress, and it keeps no reflogs.
+type gogitBackend struct{}
+
+func (gogitBackend) Open(path string) (repository, error) {
+	repo, err := gogit.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gogitRepo{repo: repo, path: path}, nil
+}
+
+func (gogitBackend) Clone(ctx context.Context, url string, path string, bare bool, opts fetchOptions) error {
+	auth, err := gogitAuth(url, opts.credentials)
+	if err != nil {
+		return err
+	}
+
+	_, err = gogit.PlainCloneContext(ctx, path, bare, &gogit.CloneOptions{
+		URL:  url,
+		Auth: auth,
+	})
+
+	return err
+}
+
+// The auth method for a URL according to the credentials, nil if
+// the remote doesn't need any.
+func gogitAuth(url string, cc *CredentialsConfig) (transport.AuthMethod, error) {
+	if cc == nil {
+		return nil, nil
+	}
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse URL '%s': %v", url, err)
+	}
+	username := cc.Username
+	if username == "" {
+		username = ep.User
+	}
+
+	switch ep.Protocol {
+	case "ssh":
+		if username == "" {
+			username = "git"
+		}
+		if cc.SSHAgent {
+			return gitssh.NewSSHAgentAuth(username)
+		}
+		if cc.SSHKey != "" {
+			passphrase := ""
+			if cc.SSHPassphraseEnv != "" {
+				passphrase = os.Getenv(cc.SSHPassphraseEnv)
+			}
+			return gitssh.NewPublicKeysFromFile(username, expandHome(cc.SSHKey), passphrase)
+		}
+	case "http", "https":
+		if cc.PasswordEnv == "" && !cc.Netrc {
+			return nil, nil
+		}
+		user, password, err := cc.userpass(url, username)
+		if err != nil {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: user, Password: password}, nil
+	}
+
+	return nil, nil
+}
+
+// Whether an error from go-git is worth retrying, known is false if
+// it isn't one of the go-git transport errors.
+func gogitRetryable(err error) (retryable bool, known bool) {
+	for _, permanent := range []error{
+		transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		transport.ErrRepositoryNotFound,
+		transport.ErrInvalidAuthMethod,
+	} {
+		if errors.Is(err, permanent) {
+			return false, true
+		}
+	}
+
+	// the HTTP errors other than 401, 403 and 404 are wrapped
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		err = unexpected.Err
+	}
+	var http_err *githttp.Err
+	if errors.As(err, &http_err) {
+		return http_err.StatusCode() >= 500, true
+	}
+
+	return false, false
+}
+
+type gogitRepo struct {
+	repo *gogit.Repository
+	path string
+}
+
+// Map go-git's not found errors to errNotFound.
+func gogitErr(err error) error {
+	if errors.Is(err, plumbing.ErrReferenceNotFound) || errors.Is(err, gogit.ErrRemoteNotFound) {
+		return fmt.Errorf("%w: %v", errNotFound, err)
+	}
+
+	return err
+}
+
+// go-git has nothing to free, it is all garbage collected.
+func (r *gogitRepo) Free() {}
+
+func (r *gogitRepo) Reopen() (repository, error) {
+	return gogitBackend{}.Open(r.path)
+}
+
+func (r *gogitRepo) IsBare() bool {
+	_, err := r.repo.Worktree()
+
+	return errors.Is(err, gogit.ErrIsBareRepository)
+}
+
+// Change the config of the repo.
+func (r *gogitRepo) updateConfig(update func(cfg *config.Config) error) error {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return fmt.Errorf("Failed to get Config: %v", err)
+	}
+
+	err = update(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.repo.SetConfig(cfg)
+}
+
+func (r *gogitRepo) Remotes() ([]string, error) {
+	remotes, err := r.repo.Remotes()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, remote := range remotes {
+		names = append(names, remote.Config().Name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (r *gogitRepo) RemoteURL(name string) (string, error) {
+	remote, err := r.repo.Remote(name)
+	if err != nil {
+		return "", gogitErr(err)
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", nil
+	}
+
+	return urls[0], nil
+}
+
+func (r *gogitRepo) CreateRemote(name string, url string) error {
+	_, err := r.repo.CreateRemote(&config.RemoteConfig{
+		Name: name,
+		URLs: []string{url},
+	})
+
+	return err
+}
+
+// The config of a remote, errNotFound if there is no such remote.
+func remoteConfig(cfg *config.Config, name string) (*config.RemoteConfig, error) {
+	rc, ok := cfg.Remotes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: remote '%s'", errNotFound, name)
+	}
+
+	return rc, nil
+}
+
+func (r *gogitRepo) SetRemoteURL(name string, url string) error {
+	return r.updateConfig(func(cfg *config.Config) error {
+		rc, err := remoteConfig(cfg, name)
+		if err != nil {
+			return err
+		}
+		rc.URLs = []string{url}
+		return nil
+	})
+}
+
+func (r *gogitRepo) FetchRefspecs(name string) ([]string, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := remoteConfig(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var refspecs []string
+	for _, refspec := range rc.Fetch {
+		refspecs = append(refspecs, refspec.String())
+	}
+
+	return refspecs, nil
+}
+
+func (r *gogitRepo) AddFetchRefspec(name string, refspec string) error {
+	return r.updateConfig(func(cfg *config.Config) error {
+		rc, err := remoteConfig(cfg, name)
+		if err != nil {
+			return err
+		}
+		rc.Fetch = append(rc.Fetch, config.RefSpec(refspec))
+		return nil
+	})
+}
+
+// go-git has no setting for these, so they are kept in the raw
+// config where git (and libgit2) will find them too.
+func (r *gogitRepo) SetNoTags(name string) error {
+	return r.updateConfig(func(cfg *config.Config) error {
+		if _, err := remoteConfig(cfg, name); err != nil {
+			return err
+		}
+		cfg.Raw.Section("remote").Subsection(name).SetOption("tagopt", "--no-tags")
+		return nil
+	})
+}
+
+func (r *gogitRepo) SetFetchPrune(prune bool) error {
+	return r.updateConfig(func(cfg *config.Config) error {
+		cfg.Raw.Section("fetch").SetOption("prune", fmt.Sprintf("%t", prune))
+		return nil
+	})
+}
+
+func (r *gogitRepo) FetchPrune() (bool, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return false, err
+	}
+
+	return cfg.Raw.Section("fetch").Option("prune") == "true", nil
+}
+
+// The (first) URL of a remote, a remote may have been configured
+// without any.
+func remoteURL(remote *gogit.Remote) (string, error) {
+	cfg := remote.Config()
+	if len(cfg.URLs) == 0 {
+		return "", fmt.Errorf("remote '%s' has no URL", cfg.Name)
+	}
+
+	return cfg.URLs[0], nil
+}
+
+func (r *gogitRepo) Fetch(ctx context.Context, name string, opts fetchOptions) error {
+	remote, err := r.repo.Remote(name)
+	if err != nil {
+		return fmt.Errorf("unable to find remote: %v", err)
+	}
+
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return err
+	}
+	tags := gogit.TagFollowing
+	if cfg.Raw.Section("remote").Subsection(name).Option("tagopt") == "--no-tags" {
+		tags = gogit.NoTags
+	}
+	prune := cfg.Raw.Section("fetch").Option("prune") == "true"
+
+	url, err := remoteURL(remote)
+	if err != nil {
+		return err
+	}
+	auth, err := gogitAuth(url, opts.credentials)
+	if err != nil {
+		return err
+	}
+
+	var refspecs []config.RefSpec
+	for _, refspec := range opts.refspecs {
+		refspecs = append(refspecs, config.RefSpec(refspec))
+	}
+
+	err = remote.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName: name,
+		RefSpecs:   refspecs,
+		Auth:       auth,
+		Tags:       tags,
+		Prune:      prune,
+	})
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return nil
+	}
+
+	return err
+}
+
+func (r *gogitRepo) Probe(ctx context.Context, url string, opts fetchOptions) error {
+	auth, err := gogitAuth(url, opts.credentials)
+	if err != nil {
+		return err
+	}
+
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "probe",
+		URLs: []string{url},
+	})
+	_, err = remote.ListContext(ctx, &gogit.ListOptions{Auth: auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil // it answered
+	}
+
+	return err
+}
+
+func (r *gogitRepo) RemoteBranches(ctx context.Context, name string, opts fetchOptions) ([]string, error) {
+	remote, err := r.repo.Remote(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find remote: %v", err)
+	}
+
+	url, err := remoteURL(remote)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := gogitAuth(url, opts.credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := remote.ListContext(ctx, &gogit.ListOptions{Auth: auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []string
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches = append(branches, ref.Name().Short())
+		}
+	}
+
+	return branches, nil
+}
+
+func gogitBranchRef(name string, kind branchKind) plumbing.ReferenceName {
+	if kind == remoteBranch {
+		return plumbing.ReferenceName("refs/remotes/" + name)
+	}
+
+	return plumbing.NewBranchReferenceName(name)
+}
+
+func (r *gogitRepo) Branches(kind branchKind) ([]string, error) {
+	refs, err := r.repo.References()
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+
+	var branches []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		switch {
+		case kind == localBranch && name.IsBranch():
+			branches = append(branches, strings.TrimPrefix(name.String(), "refs/heads/"))
+		case kind == remoteBranch && name.IsRemote():
+			branches = append(branches, strings.TrimPrefix(name.String(), "refs/remotes/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(branches)
+
+	return branches, nil
+}
+
+func (r *gogitRepo) BranchTarget(name string, kind branchKind) (string, error) {
+	return r.RefTarget(gogitBranchRef(name, kind).String())
+}
+
+func (r *gogitRepo) CreateBranch(name string, target string) error {
+	return r.CreateRef(plumbing.NewBranchReferenceName(name).String(), target, false, "")
+}
+
+func (r *gogitRepo) DeleteBranch(name string) error {
+	err := r.repo.Storer.RemoveReference(plumbing.NewBranchReferenceName(name))
+	if err != nil {
+		return err
+	}
+
+	return r.updateConfig(func(cfg *config.Config) error {
+		delete(cfg.Branches, name)
+		return nil
+	})
+}
+
+func (r *gogitRepo) IsHead(name string) (bool, error) {
+	head, err := r.repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return false, err
+	}
+
+	return head.Type() == plumbing.SymbolicReference && head.Target() == plumbing.NewBranchReferenceName(name), nil
+}
+
+func (r *gogitRepo) UpdateBranch(name string, target string, msg string) error {
+	is_head, err := r.IsHead(name)
+	if err != nil {
+		return fmt.Errorf("unable to check if '%s' is HEAD: %v", name, err)
+	}
+
+	ref_name := plumbing.NewBranchReferenceName(name)
+	hash := plumbing.NewHash(target)
+	old, err := r.repo.Reference(ref_name, true)
+	if err != nil {
+		return gogitErr(err)
+	}
+
+	// The files are checked for local changes while HEAD is still
+	// the old commit.  Then the ref is moved first so that a failed
+	// update leaves the worktree alone, and moved back if writing the
+	// files fails.
+	var changes object.Changes
+	checkout := is_head && !r.IsBare()
+	if checkout {
+		changes, err = r.checkoutChanges(old.Hash(), hash)
+		if err != nil {
+			return fmt.Errorf("unable to checkout '%s', local changes?: %v", name, err)
+		}
+	}
+
+	err = r.repo.Storer.SetReference(plumbing.NewHashReference(ref_name, hash))
+	if err != nil {
+		return fmt.Errorf("Update of '%s' failed: %v", name, err)
+	}
+
+	if !checkout {
+		return nil
+	}
+
+	err = r.writeChanges(changes)
+	if err != nil {
+		back_err := r.repo.Storer.SetReference(plumbing.NewHashReference(ref_name, old.Hash()))
+		if back_err != nil {
+			return fmt.Errorf("unable to checkout '%s' (%v) or to move it back: %v", name, err, back_err)
+		}
+		return fmt.Errorf("unable to checkout '%s': %v", name, err)
+	}
+
+	return nil
+}
+
+// The changes of a safe checkout from one commit to another (go-git
+// only has a reset, which would lose the local edits), an error if
+// any of the files that differ between them has a local change.  It
+// has to be called while HEAD is still at from.
+func (r *gogitRepo) checkoutChanges(from plumbing.Hash, to plumbing.Hash) (object.Changes, error) {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	from_tree, err := r.commitTree(from)
+	if err != nil {
+		return nil, err
+	}
+	to_tree, err := r.commitTree(to)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(from_tree, to_tree)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := wt.Status()
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		for _, path := range []string{change.From.Name, change.To.Name} {
+			file, ok := status[path]
+			if path != "" && ok && (file.Staging != gogit.Unmodified || file.Worktree != gogit.Unmodified) {
+				return nil, fmt.Errorf("'%s' has local changes", path)
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// Write the files and index entries of the changes from
+// checkoutChanges, only the files that differ are written.
+func (r *gogitRepo) writeChanges(changes object.Changes) error {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	idx, err := r.repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		from_file, to_file, err := change.Files()
+		if err != nil {
+			return err
+		}
+
+		if from_file != nil && (to_file == nil || change.From.Name != change.To.Name) {
+			err = wt.Filesystem.Remove(change.From.Name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			idx.Remove(change.From.Name)
+		}
+		if to_file == nil {
+			continue
+		}
+
+		err = writeFile(wt, to_file)
+		if err != nil {
+			return fmt.Errorf("unable to write '%s': %v", to_file.Name, err)
+		}
+		info, err := wt.Filesystem.Lstat(to_file.Name)
+		if err != nil {
+			return err
+		}
+		entry, err := idx.Entry(to_file.Name)
+		if err != nil {
+			entry = idx.Add(to_file.Name)
+		}
+		entry.Hash = to_file.Hash
+		entry.Mode = to_file.Mode
+		entry.ModifiedAt = info.ModTime()
+		entry.Size = uint32(info.Size())
+	}
+
+	return r.repo.Storer.SetIndex(idx)
+}
+
+func (r *gogitRepo) commitTree(hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// Write a file of a tree to the worktree.
+func writeFile(wt *gogit.Worktree, file *object.File) error {
+	contents, err := file.Contents()
+	if err != nil {
+		return err
+	}
+
+	err = wt.Filesystem.Remove(file.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if file.Mode == filemode.Symlink {
+		return wt.Filesystem.Symlink(contents, file.Name)
+	}
+
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+	out, err := wt.Filesystem.OpenFile(file.Name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = out.Write([]byte(contents))
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func (r *gogitRepo) Upstream(name string) (string, string, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get Config: %v", err)
+	}
+
+	branch, ok := cfg.Branches[name]
+	if !ok || branch.Remote == "" || branch.Merge == "" {
+		return "", "", nil
+	}
+
+	return branch.Remote, branch.Merge.String(), nil
+}
+
+func (r *gogitRepo) SetUpstream(name string, remote string, merge string) error {
+	return r.updateConfig(func(cfg *config.Config) error {
+		branch, ok := cfg.Branches[name]
+		if !ok {
+			branch = &config.Branch{Name: name}
+			cfg.Branches[name] = branch
+		}
+		branch.Remote = remote
+		branch.Merge = plumbing.ReferenceName(merge)
+		return nil
+	})
+}
+
+func (r *gogitRepo) RefTarget(name string) (string, error) {
+	ref, err := r.repo.Reference(plumbing.ReferenceName(name), true)
+	if err != nil {
+		return "", gogitErr(err)
+	}
+
+	return ref.Hash().String(), nil
+}
+
+func (r *gogitRepo) CreateRef(name string, target string, force bool, msg string) error {
+	ref_name := plumbing.ReferenceName(name)
+	if !force {
+		_, err := r.repo.Storer.Reference(ref_name)
+		if err == nil {
+			return fmt.Errorf("reference '%s' already exists", name)
+		}
+		if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return err
+		}
+	}
+
+	return r.repo.Storer.SetReference(plumbing.NewHashReference(ref_name, plumbing.NewHash(target)))
+}
+
+func (r *gogitRepo) DeleteRef(name string) error {
+	ref_name := plumbing.ReferenceName(name)
+	_, err := r.repo.Storer.Reference(ref_name)
+	if err != nil {
+		return gogitErr(err)
+	}
+
+	return r.repo.Storer.RemoveReference(ref_name)
+}
+
+func (r *gogitRepo) SymbolicRef(name string) (string, error) {
+	ref, err := r.repo.Storer.Reference(plumbing.ReferenceName(name))
+	if err != nil {
+		return "", gogitErr(err)
+	}
+
+	if ref.Type() != plumbing.SymbolicReference {
+		return "", nil
+	}
+
+	return ref.Target().String(), nil
+}
+
+// go-git doesn't keep reflogs, so there is nowhere for the message.
+func (r *gogitRepo) CreateSymbolicRef(name string, target string, msg string) error {
+	return r.repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.ReferenceName(name), plumbing.ReferenceName(target)))
+}
+
+func (r *gogitRepo) DescendantOf(commit string, ancestor string) (bool, error) {
+	if commit == ancestor {
+		return false, nil
+	}
+
+	c, err := r.repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return false, err
+	}
+	a, err := r.repo.CommitObject(plumbing.NewHash(ancestor))
+	if err != nil {
+		return false, err
+	}
+
+	return a.IsAncestor(c)
+}
+
+func (r *gogitRepo) ReadFile(commit string, path string) ([]byte, error) {
+	c, err := r.repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := c.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(contents), nil
+}
@@ -0,0 +1,650 @@
+//go:build !nolibgit2
+
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/libgit2/git2go"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The backend on libgit2, through git2go.  It needs cgo and libgit2
+// so it can be left out with the nolibgit2 build tag, then the other
+// backends work without them.
+type libgit2Backend struct{}
+
+func init() {
+	backends["libgit2"] = libgit2Backend{}
+}
+
+func (libgit2Backend) Open(path string) (repository, error) {
+	repo, err := git.OpenRepository(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &libgit2Repo{repo: repo, owned: true}, nil
+}
+
+func (libgit2Backend) Clone(ctx context.Context, url string, path string, bare bool, opts fetchOptions) error {
+	repo, err := git.Clone(url, path, &git.CloneOptions{
+		FetchOptions: &git.FetchOptions{
+			RemoteCallbacks: remoteCallbacks(ctx, opts),
+			UpdateFetchhead: true,
+		},
+		Bare: bare,
+	})
+	if err != nil {
+		return err
+	}
+	repo.Free()
+
+	return nil
+}
+
+// A libgit2 repo.  Repos handed in by the caller (e.g. to FetchAll)
+// aren't owned, so they aren't freed.
+type libgit2Repo struct {
+	repo  *git.Repository
+	owned bool
+}
+
+// Wrap a repo of the caller.
+func newLibgit2Repo(repo *git.Repository) *libgit2Repo {
+	return &libgit2Repo{repo: repo}
+}
+
+// Map libgit2's not found to errNotFound.
+func libgit2Err(err error) error {
+	if git.IsErrorCode(err, git.ErrNotFound) {
+		return fmt.Errorf("%w: %v", errNotFound, err)
+	}
+
+	return err
+}
+
+func (r *libgit2Repo) Free() {
+	if r.owned {
+		r.repo.Free()
+	}
+}
+
+func (r *libgit2Repo) Reopen() (repository, error) {
+	return libgit2Backend{}.Open(r.repo.Path())
+}
+
+func (r *libgit2Repo) IsBare() bool {
+	return r.repo.IsBare()
+}
+
+func (r *libgit2Repo) Remotes() ([]string, error) {
+	return r.repo.Remotes.List()
+}
+
+func (r *libgit2Repo) RemoteURL(name string) (string, error) {
+	remote, err := r.repo.Remotes.Lookup(name)
+	if err != nil {
+		return "", libgit2Err(err)
+	}
+	defer remote.Free()
+
+	return remote.Url(), nil
+}
+
+func (r *libgit2Repo) CreateRemote(name string, url string) error {
+	remote, err := r.repo.Remotes.Create(name, url)
+	if err != nil {
+		return err
+	}
+	remote.Free()
+
+	return nil
+}
+
+func (r *libgit2Repo) SetRemoteURL(name string, url string) error {
+	return r.repo.Remotes.SetUrl(name, url)
+}
+
+func (r *libgit2Repo) FetchRefspecs(name string) ([]string, error) {
+	remote, err := r.repo.Remotes.Lookup(name)
+	if err != nil {
+		return nil, libgit2Err(err)
+	}
+	defer remote.Free()
+
+	return remote.FetchRefspecs()
+}
+
+func (r *libgit2Repo) AddFetchRefspec(name string, refspec string) error {
+	return r.repo.Remotes.AddFetch(name, refspec)
+}
+
+func (r *libgit2Repo) SetNoTags(name string) error {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return err
+	}
+	defer cfg.Free()
+
+	return cfg.SetString(fmt.Sprintf("remote.%s.tagopt", name), "--no-tags")
+}
+
+func (r *libgit2Repo) SetFetchPrune(prune bool) error {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return err
+	}
+	defer cfg.Free()
+
+	return cfg.SetBool("fetch.prune", prune)
+}
+
+func (r *libgit2Repo) FetchPrune() (bool, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return false, err
+	}
+	defer cfg.Free()
+
+	prune, err := cfg.LookupBool("fetch.prune")
+	if git.IsErrorCode(err, git.ErrNotFound) {
+		return false, nil
+	}
+
+	return prune, err
+}
+
+// Callbacks for a transfer from the remote.  They provide the
+// credentials, if the remote has any, pass the progress on and abort
+// the transfer once the context is done.
+//
+// They are only called when there is progress, so on their own they
+// can't stop a transfer that is stuck waiting on the network (see
+// runContext).
+func remoteCallbacks(ctx context.Context, opts fetchOptions) git.RemoteCallbacks {
+	check := func() git.ErrorCode {
+		if ctx.Err() != nil {
+			return git.ErrorCodeUser
+		}
+		return git.ErrorCodeOK
+	}
+
+	callbacks := git.RemoteCallbacks{
+		SidebandProgressCallback: func(str string) git.ErrorCode {
+			return check()
+		},
+		TransferProgressCallback: func(stats git.TransferProgress) git.ErrorCode {
+			if opts.progress != nil && ctx.Err() == nil {
+				opts.progress(FetchProgress{
+					Remote:          opts.remote,
+					TotalObjects:    stats.TotalObjects,
+					ReceivedObjects: stats.ReceivedObjects,
+					IndexedObjects:  stats.IndexedObjects,
+					ReceivedBytes:   stats.ReceivedBytes,
+				})
+			}
+			return check()
+		},
+		UpdateTipsCallback: func(refname string, a *git.Oid, b *git.Oid) git.ErrorCode {
+			return check()
+		},
+	}
+	if opts.credentials != nil {
+		callbacks.CredentialsCallback = opts.credentials.callback()
+	}
+
+	return callbacks
+}
+
+func (r *libgit2Repo) Fetch(ctx context.Context, name string, opts fetchOptions) error {
+	remote, err := r.repo.Remotes.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("unable to find remote: %v", err)
+	}
+	defer remote.Free()
+
+	return remote.Fetch(opts.refspecs, &git.FetchOptions{
+		RemoteCallbacks: remoteCallbacks(ctx, opts),
+		UpdateFetchhead: true,
+	}, "")
+}
+
+func (r *libgit2Repo) Probe(ctx context.Context, url string, opts fetchOptions) error {
+	remote, err := r.repo.Remotes.CreateAnonymous(url)
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+
+	callbacks := remoteCallbacks(ctx, opts)
+	err = remote.ConnectFetch(&callbacks, nil, nil)
+	if err != nil {
+		return err
+	}
+	remote.Disconnect()
+
+	return nil
+}
+
+func (r *libgit2Repo) RemoteBranches(ctx context.Context, name string, opts fetchOptions) ([]string, error) {
+	remote, err := r.repo.Remotes.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find remote: %v", err)
+	}
+	defer remote.Free()
+
+	callbacks := remoteCallbacks(ctx, opts)
+	err = remote.ConnectFetch(&callbacks, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	heads, err := remote.Ls()
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []string
+	for _, head := range heads {
+		if strings.HasPrefix(head.Name, "refs/heads/") {
+			branches = append(branches, strings.TrimPrefix(head.Name, "refs/heads/"))
+		}
+	}
+
+	return branches, nil
+}
+
+func libgit2BranchType(kind branchKind) git.BranchType {
+	if kind == remoteBranch {
+		return git.BranchRemote
+	}
+
+	return git.BranchLocal
+}
+
+func (r *libgit2Repo) Branches(kind branchKind) ([]string, error) {
+	var branches []string
+	iter, err := r.repo.NewBranchIterator(libgit2BranchType(kind))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	for {
+		ref, _, err := iter.Next()
+		if err != nil {
+			break
+		}
+		branch, _ := ref.Branch().Name() // fedora/f31
+		branches = append(branches, branch)
+	}
+
+	return branches, nil
+}
+
+func (r *libgit2Repo) BranchTarget(name string, kind branchKind) (string, error) {
+	branch, err := r.repo.LookupBranch(name, libgit2BranchType(kind))
+	if err != nil {
+		return "", libgit2Err(err)
+	}
+	defer branch.Free()
+
+	return branch.Target().String(), nil
+}
+
+func (r *libgit2Repo) lookupCommit(oid string) (*git.Commit, error) {
+	id, err := git.NewOid(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.repo.LookupCommit(id)
+}
+
+func (r *libgit2Repo) CreateBranch(name string, target string) error {
+	commit, err := r.lookupCommit(target)
+	if err != nil {
+		return fmt.Errorf("lookup commit failed: %v", err)
+	}
+	defer commit.Free()
+
+	branch, err := r.repo.CreateBranch(name, commit, false)
+	if err != nil {
+		return err
+	}
+	branch.Free()
+
+	return nil
+}
+
+func (r *libgit2Repo) DeleteBranch(name string) error {
+	branch, err := r.repo.LookupBranch(name, git.BranchLocal)
+	if err != nil {
+		return libgit2Err(err)
+	}
+	defer branch.Free()
+
+	// this also removes the branch.<branch>.* tracking config
+	return branch.Delete()
+}
+
+func (r *libgit2Repo) IsHead(name string) (bool, error) {
+	branch, err := r.repo.LookupBranch(name, git.BranchLocal)
+	if err != nil {
+		return false, libgit2Err(err)
+	}
+	defer branch.Free()
+
+	return branch.IsHead()
+}
+
+// Check out the tree of commit over the one of old, without losing
+// local edits.
+func (r *libgit2Repo) checkoutOver(commit *git.Commit, old *git.Commit) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	old_tree, err := old.Tree()
+	if err != nil {
+		return err
+	}
+	defer old_tree.Free()
+
+	return r.repo.CheckoutTree(tree, &git.CheckoutOpts{
+		Strategy: git.CheckoutSafe,
+		Baseline: old_tree,
+	})
+}
+
+func (r *libgit2Repo) UpdateBranch(name string, target string, msg string) error {
+	branch, err := r.repo.LookupBranch(name, git.BranchLocal)
+	if err != nil {
+		return libgit2Err(err)
+	}
+	defer branch.Free()
+
+	is_head, err := branch.IsHead()
+	if err != nil {
+		return fmt.Errorf("unable to check if '%s' is HEAD: %v", name, err)
+	}
+
+	commit, err := r.lookupCommit(target)
+	if err != nil {
+		return fmt.Errorf("lookup commit failed: %v", err)
+	}
+	defer commit.Free()
+
+	old, err := r.repo.LookupCommit(branch.Target())
+	if err != nil {
+		return fmt.Errorf("lookup commit failed: %v", err)
+	}
+	defer old.Free()
+
+	// The ref is moved first so that a failed update leaves the
+	// worktree alone.  The checkout is then against the old tree,
+	// since HEAD already has the new one, and if it fails the ref is
+	// moved back.
+	ref, err := branch.Reference.SetTarget(commit.Id(), msg)
+	if err != nil {
+		return fmt.Errorf("Update of '%s' failed: %v", name, err)
+	}
+	defer ref.Free()
+
+	if !is_head || r.repo.IsBare() {
+		return nil
+	}
+
+	err = r.checkoutOver(commit, old)
+	if err != nil {
+		back, back_err := ref.SetTarget(old.Id(), "pull: undo, checkout failed")
+		if back_err != nil {
+			return fmt.Errorf("unable to checkout '%s' (%v) or to move it back: %v", name, err, back_err)
+		}
+		back.Free()
+		return fmt.Errorf("unable to checkout '%s', local changes?: %v", name, err)
+	}
+
+	return nil
+}
+
+func (r *libgit2Repo) Upstream(name string) (string, string, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get Config: %v", err)
+	}
+	defer cfg.Free()
+
+	remote, err := cfg.LookupString(fmt.Sprintf("branch.%s.remote", name))
+	if err != nil {
+		return "", "", nil
+	}
+	merge, err := cfg.LookupString(fmt.Sprintf("branch.%s.merge", name))
+	if err != nil {
+		return "", "", nil
+	}
+
+	return remote, merge, nil
+}
+
+func (r *libgit2Repo) SetUpstream(name string, remote string, merge string) error {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return fmt.Errorf("Failed to get Config: %v", err)
+	}
+	defer cfg.Free()
+
+	err = cfg.SetString(fmt.Sprintf("branch.%s.remote", name), remote)
+	if err != nil {
+		return fmt.Errorf("Failed to set config remote: %v", err)
+	}
+	err = cfg.SetString(fmt.Sprintf("branch.%s.merge", name), merge)
+	if err != nil {
+		return fmt.Errorf("Failed to set config merge: %v", err)
+	}
+
+	return nil
+}
+
+func (r *libgit2Repo) RefTarget(name string) (string, error) {
+	ref, err := r.repo.References.Lookup(name)
+	if err != nil {
+		return "", libgit2Err(err)
+	}
+	defer ref.Free()
+
+	resolved, err := ref.Resolve()
+	if err != nil {
+		return "", err
+	}
+	defer resolved.Free()
+
+	return resolved.Target().String(), nil
+}
+
+func (r *libgit2Repo) CreateRef(name string, target string, force bool, msg string) error {
+	id, err := git.NewOid(target)
+	if err != nil {
+		return err
+	}
+
+	ref, err := r.repo.References.Create(name, id, force, msg)
+	if err != nil {
+		return err
+	}
+	ref.Free()
+
+	return nil
+}
+
+func (r *libgit2Repo) DeleteRef(name string) error {
+	ref, err := r.repo.References.Lookup(name)
+	if err != nil {
+		return libgit2Err(err)
+	}
+	defer ref.Free()
+
+	return ref.Delete()
+}
+
+func (r *libgit2Repo) SymbolicRef(name string) (string, error) {
+	ref, err := r.repo.References.Lookup(name)
+	if err != nil {
+		return "", libgit2Err(err)
+	}
+	defer ref.Free()
+
+	if ref.Type() != git.ReferenceSymbolic {
+		return "", nil
+	}
+
+	return ref.SymbolicTarget(), nil
+}
+
+func (r *libgit2Repo) CreateSymbolicRef(name string, target string, msg string) error {
+	ref, err := r.repo.References.CreateSymbolic(name, target, true, msg)
+	if err != nil {
+		return err
+	}
+	ref.Free()
+
+	return nil
+}
+
+func (r *libgit2Repo) DescendantOf(commit string, ancestor string) (bool, error) {
+	commit_id, err := git.NewOid(commit)
+	if err != nil {
+		return false, err
+	}
+	ancestor_id, err := git.NewOid(ancestor)
+	if err != nil {
+		return false, err
+	}
+
+	return r.repo.DescendantOf(commit_id, ancestor_id)
+}
+
+func (r *libgit2Repo) ReadFile(commit string, path string) ([]byte, error) {
+	id, err := git.NewOid(commit)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.repo.LookupCommit(id)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Free()
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	entry, err := tree.EntryByPath(path)
+	if err != nil {
+		return nil, libgit2Err(err)
+	}
+	blob, err := r.repo.LookupBlob(entry.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Free()
+
+	return blob.Contents(), nil
+}
+
+// Make the libgit2 callback that hands out the credentials.
+func (cc *CredentialsConfig) callback() git.CredentialsCallback {
+	attempts := 0
+
+	return func(remote_url string, username_from_url string, allowed_types git.CredentialType) (*git.Credential, error) {
+		attempts++
+		if attempts > maxCredentialAttempts {
+			return nil, fmt.Errorf("credentials for '%s' were rejected", remote_url)
+		}
+
+		username := cc.Username
+		if username == "" {
+			username = username_from_url
+		}
+
+		if allowed_types&git.CredentialTypeSSHKey != 0 {
+			if username == "" {
+				username = "git"
+			}
+			if cc.SSHAgent {
+				return git.NewCredentialSSHKeyFromAgent(username)
+			}
+			if cc.SSHKey != "" {
+				key := expandHome(cc.SSHKey)
+				pub := key + ".pub"
+				if _, err := os.Stat(pub); err != nil {
+					pub = ""
+				}
+				passphrase := ""
+				if cc.SSHPassphraseEnv != "" {
+					passphrase = os.Getenv(cc.SSHPassphraseEnv)
+				}
+				return git.NewCredentialSSHKey(username, pub, key, passphrase)
+			}
+		}
+
+		if allowed_types&git.CredentialTypeUserpassPlaintext != 0 {
+			user, password, err := cc.userpass(remote_url, username)
+			if err != nil {
+				return nil, err
+			}
+			return git.NewCredentialUserpassPlaintext(user, password)
+		}
+
+		// SSH first asks for the user name if the URL doesn't have one
+		if allowed_types&git.CredentialTypeUsername != 0 {
+			if username == "" {
+				username = "git"
+			}
+			return git.NewCredentialUsername(username)
+		}
+
+		return nil, fmt.Errorf("no usable credentials for '%s'", remote_url)
+	}
+}
+
+// Finds the status in libgit2 errors such as
+//
+//	unexpected http status code: 502
+var httpStatusRe = regexp.MustCompile(`(?i)http status code: (\d{3})`)
+
+// Whether an error from libgit2 is worth retrying, known is false if
+// it isn't a libgit2 error.
+func libgit2Retryable(err error) (retryable bool, known bool) {
+	var git_err *git.GitError
+	if !errors.As(err, &git_err) {
+		return false, false
+	}
+
+	switch git_err.Code {
+	case git.ErrorCodeAuth, git.ErrorCodeCertificate, git.ErrorCodeNotFound, git.ErrorCodeUser:
+		return false, true
+	}
+
+	match := httpStatusRe.FindStringSubmatch(git_err.Message)
+	if match != nil {
+		status, _ := strconv.Atoi(match[1])
+		return status >= 500, true
+	}
+
+	switch git_err.Class {
+	case git.ErrorClassNet, git.ErrorClassSSH, git.ErrorClassSSL:
+		return true, true
+	}
+
+	return false, true
+}
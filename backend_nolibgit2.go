@@ -0,0 +1,8 @@
+//go:build nolibgit2
+
+package rgm
+
+// Without libgit2 there are no libgit2 errors, see libgit2Retryable.
+func libgit2Retryable(err error) (retryable bool, known bool) {
+	return false, false
+}
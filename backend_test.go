@@ -0,0 +1,28 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"testing"
+)
+
+// Skip tests of the functions that take a libgit2 repo when testing
+// another backend, they would only repeat the same test.
+func onlyLibgit2(t *testing.T) {
+	t.Helper()
+
+	if rgm.DefaultBackend() != "libgit2" {
+		t.Skipf("uses libgit2 directly, not the %s backend", rgm.DefaultBackend())
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	cfg := rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+		Backend: "cvs",
+	}
+
+	_, err := rgm.NewMirror(cfg, "patch", t.TempDir(), rgm.Options{})
+	if err == nil {
+		t.Errorf("expected an unknown backend to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package rgm
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A pattern for the branches of a remote, either a glob (see
+// path.Match) or a regular expression between slashes.
+//
+//	"f3*"
+//	"/^c[0-9]+s?$/"
+type branchPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func parseBranchPattern(pattern string) (branchPattern, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return branchPattern{}, fmt.Errorf("bad regexp '%s': %v", pattern, err)
+		}
+		return branchPattern{re: re}, nil
+	}
+
+	if pattern == "" {
+		return branchPattern{}, fmt.Errorf("empty pattern")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return branchPattern{}, fmt.Errorf("bad glob '%s': %v", pattern, err)
+	}
+
+	return branchPattern{glob: pattern}, nil
+}
+
+func (p branchPattern) match(branch string) bool {
+	if p.re != nil {
+		return p.re.MatchString(branch)
+	}
+	ok, _ := path.Match(p.glob, branch)
+
+	return ok
+}
+
+// The branches of a remote that are mirrored.  A nil filter lets
+// all of them through.
+type branchFilter struct {
+	include []branchPattern
+	exclude []branchPattern
+}
+
+func parseBranchPatterns(patterns []string) ([]branchPattern, error) {
+	var parsed []branchPattern
+	for _, pattern := range patterns {
+		p, err := parseBranchPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+
+	return parsed, nil
+}
+
+// The branch filter of the remote, nil if it doesn't have one.
+func (rc *RemoteConfig) branchFilter() (*branchFilter, error) {
+	if len(rc.IncludeBranches) == 0 && len(rc.ExcludeBranches) == 0 {
+		return nil, nil
+	}
+
+	include, err := parseBranchPatterns(rc.IncludeBranches)
+	if err != nil {
+		return nil, fmt.Errorf("IncludeBranches of remote '%s': %v", rc.Name, err)
+	}
+	exclude, err := parseBranchPatterns(rc.ExcludeBranches)
+	if err != nil {
+		return nil, fmt.Errorf("ExcludeBranches of remote '%s': %v", rc.Name, err)
+	}
+
+	return &branchFilter{include: include, exclude: exclude}, nil
+}
+
+func (f *branchFilter) match(branch string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, p := range f.exclude {
+		if p.match(branch) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p.match(branch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether a branch of the remote (e.g. f31) is mirrored according
+// to its IncludeBranches and ExcludeBranches.
+func (rc *RemoteConfig) MatchBranch(branch string) (bool, error) {
+	filter, err := rc.branchFilter()
+	if err != nil {
+		return false, err
+	}
+
+	return filter.match(branch), nil
+}
+
+// The branch filters of the remotes by name, the remotes without one
+// aren't in it.
+func branchFilters(rcs []RemoteConfig) (map[string]*branchFilter, error) {
+	filters := make(map[string]*branchFilter)
+	for i := range rcs {
+		filter, err := rcs[i].branchFilter()
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			filters[rcs[i].Name] = filter
+		}
+	}
+
+	return filters, nil
+}
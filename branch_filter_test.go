@@ -0,0 +1,50 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"testing"
+)
+
+func TestMatchBranch(t *testing.T) {
+	rc := rgm.RemoteConfig{
+		Name:            "centos",
+		IncludeBranches: []string{"/^c[0-9]+s?$/", "imports/*"},
+		ExcludeBranches: []string{"c4", "c5", "private-*"},
+	}
+
+	cases := []struct {
+		Branch string
+		Match  bool
+	}{
+		{"c7", true},
+		{"c8s", true},
+		{"c4", false},   // excluded
+		{"c10x", false}, // not included
+		{"imports/c7", true},
+		{"imports/c7/extra", false}, // * doesn't match a /
+		{"private-c7", false},
+		{"master", false},
+	}
+	for _, c := range cases {
+		match, err := rc.MatchBranch(c.Branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != c.Match {
+			t.Errorf("expected match of '%s' to be %v", c.Branch, c.Match)
+		}
+	}
+
+	// without IncludeBranches all but the excluded ones match
+	rc = rgm.RemoteConfig{Name: "fedora", ExcludeBranches: []string{"f2?"}}
+	for branch, expected := range map[string]bool{"f29": false, "f31": true, "master": true} {
+		if match, _ := rc.MatchBranch(branch); match != expected {
+			t.Errorf("expected match of '%s' to be %v", branch, expected)
+		}
+	}
+
+	rc = rgm.RemoteConfig{Name: "fedora", IncludeBranches: []string{"/f(/"}}
+	if _, err := rc.MatchBranch("f31"); err == nil {
+		t.Errorf("expected a bad regexp to fail")
+	}
+}
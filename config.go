@@ -2,75 +2,238 @@ package rgm
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
 	"text/template"
+	"time"
 )
 
 type Config struct {
 	Origin  RemoteConfig
 	Remotes []RemoteConfig
+	// What to do with local branches whose upstream branch was
+	// deleted (e.g. a retired fedora/f29).  By default nothing is
+	// pruned.
+	Prune PrunePolicy
+	// What to do with a branch that was rewritten upstream and
+	// can't be fast-forwarded.  By default it is skipped.
+	Diverged DivergedPolicy
+	// Names for the branches of a release across the remotes,
+	// kept as aliases (symbolic refs) of the local branches.  Each
+	// release has aliases of <remote>/<branch>.
+	//
+	//   "Releases": {"el8": {"centos": "centos/c8s", "fedora-epel": "fedora/epel8"}}
+	//
+	//   refs/heads/release/el8/centos -> refs/heads/centos/c8s
+	Releases map[string]map[string]string
+	// Where the sources of the branches are downloaded to from the
+	// lookaside caches of the remotes, see Mirror.Sources.  It can
+	// be shared by any number of mirrors.  Nothing is downloaded if
+	// it isn't set.
+	SourcesCache string
+	// Mirror in to a bare repo, without a worktree.
+	Bare bool
+	// Retries of a failed fetch or clone for the remotes that
+	// don't have their own.  No retries by default.
+	Retry RetryConfig
+	// What does the git operations, "libgit2", "go-git" (a pure
+	// Go git) or "exec" (the git binary).  DefaultBackend if it
+	// isn't set.  libgit2 isn't there when built with nolibgit2.
+	Backend string
 }
 
-// Given a config object (template), fill out the variables.
-//   "URL": ["https://src.fedoraproject.org/rpms/{{.RPM}}.git"]
-func ExecConfigTemplate(cfg Config, rpm string) (Config, error) {
+// A time.Duration that is written as a string in the config.
+//
+//	"Timeout": "90s"
+type Duration time.Duration
 
-	// This copies the given object to a new object while
-	// also filling out the template variables.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
 
-	var new_cfg Config
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// The data the URL templates are executed with.  The BranchName
+// templates only have the Remote and the Branch, and only the
+// Lookaside ones have a source (Filename, Hash and HashType).
+//
+//	"URL": "https://{{env "DISTGIT_HOST"}}/rpms/{{.RPM | first}}/{{.Name}}.git"
+//	"BranchName": "dist/{{.Remote}}/{{.Branch | trimPrefix \"f\"}}"
+type TemplateData struct {
+	// The name of the RPM (e.g. patch).
+	RPM string
+	// The name of the RPM on the remote, which is the RPM unless
+	// the remote has an override for it in Names.
+	Name string
+	// The name of the remote (e.g. fedora).
+	Remote string
+	// The branch of the remote (e.g. f31).
+	Branch string
+	// A source of the branch (e.g. patch-2.7.6.tar.xz), its hash
+	// and the type of the hash (e.g. sha512).
+	Filename string
+	Hash     string
+	HashType string
+}
+
+// The functions the templates can use, on top of the ones of
+// text/template.
+//
+//	lower       lower case                  {{.RPM | lower}}
+//	urlquery    escape for a URL            {{.RPM | urlquery}}
+//	first       the first letter            {{.RPM | first}}
+//	env         an environment variable     {{env "DISTGIT_HOST"}}
+//	trimPrefix  remove a prefix             {{.Branch | trimPrefix "c"}}
+//	trimSuffix  remove a suffix             {{.Branch | trimSuffix "-sig"}}
+//	replace     replace all of a substring  {{.Branch | replace "." "-"}}
+var templateFuncs = template.FuncMap{
+	"lower":    strings.ToLower,
+	"urlquery": url.QueryEscape,
+	"trimPrefix": func(prefix string, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix string, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"replace": func(old string, new string, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"first": func(s string) string {
+		for _, r := range s {
+			return string(r)
+		}
+		return ""
+	},
+	"env": func(name string) (string, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' isn't set", name)
+		}
+		return value, nil
+	},
+}
 
-	new_cfg.Origin = RemoteConfig{
-		Name: cfg.Origin.Name,
-		URL:  cfg.Origin.URL,
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("URL").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template '%s': %v", text, err)
 	}
 
-	tmpl, err := template.New("URL").Parse(cfg.Origin.URL)
+	return tmpl, nil
+}
+
+// Fill out the template variables in a single string.
+func execTemplate(text string, data TemplateData) (string, error) {
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
 
-	vars := struct{ RPM string }{rpm}
 	out := new(bytes.Buffer)
-	err = tmpl.Execute(out, vars)
+	err = tmpl.Execute(out, data)
 	if err != nil {
-		return new_cfg, fmt.Errorf("unable to exec template '%s' for '%s': %v", cfg.Origin.URL, rpm, err)
+		return "", fmt.Errorf("unable to exec template '%s' for '%s': %v", text, data.RPM, err)
 	}
 
-	new_cfg.Origin.URL = string(out.String())
+	return out.String(), nil
+}
 
-	new_cfg.Remotes = make([]RemoteConfig, len(cfg.Remotes))
-	for i, remote := range cfg.Remotes {
-		tmpl, err := template.New("URL").Parse(remote.URL)
+// The template data of a remote for an RPM.
+func (rc *RemoteConfig) templateData(rpm string) TemplateData {
+	name := rpm
+	if override, ok := rc.Names[rpm]; ok {
+		name = override
+	}
 
-		vars := struct{ RPM string }{rpm}
-		out := new(bytes.Buffer)
-		err = tmpl.Execute(out, vars)
+	return TemplateData{RPM: rpm, Name: name, Remote: rc.Name}
+}
+
+// Fill out the URL and each of the URLs of a remote config.
+func execRemoteConfigTemplate(rc RemoteConfig, rpm string) (RemoteConfig, error) {
+	var err error
+
+	new_rc := rc
+	data := rc.templateData(rpm)
+
+	new_rc.URL, err = execTemplate(rc.URL, data)
+	if err != nil {
+		return new_rc, err
+	}
+
+	// a new slice so the template isn't modified
+	new_rc.URLs = nil
+	for _, url := range rc.URLs {
+		new_url, err := execTemplate(url, data)
 		if err != nil {
-			return new_cfg, fmt.Errorf("unable to exec template '%s' for '%s': %v", remote.URL, rpm, err)
+			return new_rc, err
 		}
-		new_url := string(out.String())
+		new_rc.URLs = append(new_rc.URLs, new_url)
+	}
+
+	return new_rc, nil
+}
+
+// Given a config object (template), fill out the variables (see
+// TemplateData).
+//
+//	"URLs": ["https://src.fedoraproject.org/rpms/{{.RPM}}.git"]
+func ExecConfigTemplate(cfg Config, rpm string) (Config, error) {
+
+	// This copies the given object to a new object while
+	// also filling out the template variables.
 
-		new_cfg.Remotes[i].Name = remote.Name
-		new_cfg.Remotes[i].URL = new_url
+	var err error
+
+	// the settings without templates are copied as is
+	new_cfg := cfg
+
+	new_cfg.Origin, err = execRemoteConfigTemplate(cfg.Origin, rpm)
+	if err != nil {
+		return new_cfg, err
+	}
+
+	new_cfg.Remotes = make([]RemoteConfig, len(cfg.Remotes))
+	for i, remote := range cfg.Remotes {
+		new_cfg.Remotes[i], err = execRemoteConfigTemplate(remote, rpm)
+		if err != nil {
+			return new_cfg, err
+		}
 	}
 
 	return new_cfg, nil // OK
 }
 
+// Load a config (template) from a JSON, YAML or TOML file, see
+// configFormat, and check it with Validate.
 func LoadConfig(config_file string) (Config, error) {
+	cfg, _, err := LoadConfigLayers([]string{config_file})
 
-	var err error
-	var cfg Config
+	return cfg, err
+}
 
-	file, err := ioutil.ReadFile(config_file)
+// Read a config file and convert it to JSON.
+func readConfigJSON(config_file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(config_file)
 	if err != nil {
-		return cfg, fmt.Errorf("unable to read '%s': %v", config_file, err)
+		return nil, fmt.Errorf("unable to read '%s': %v", config_file, err)
 	}
 
-	err = json.Unmarshal(file, &cfg)
+	format := configFormat(config_file, data)
+	file, err := configJSON(format, data)
 	if err != nil {
-		return cfg, fmt.Errorf("Unmarshal of '%s' failed: %v", config_file, err)
+		return nil, fmt.Errorf("unable to parse '%s' as %s: %v", config_file, strings.ToUpper(format), err)
 	}
 
-	return cfg, nil
+	return file, nil
 }
@@ -0,0 +1,81 @@
+package rgm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The formats a config can be written in.  They all have the same
+// settings as the JSON one.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Matches a TOML table or key = value line, e.g.
+//
+//	[Origin]
+//	[[Remotes]]
+//	Prune = "delete"
+var tomlLineRe = regexp.MustCompile(`(?m)^\s*(\[[^\]]*\]|[\w."-]+\s*=)`)
+
+// Get the format of a config from the extension of its file or, if
+// the extension doesn't say, from what it looks like.
+func configFormat(config_file string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(config_file)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return FormatJSON
+	case tomlLineRe.Match(data):
+		return FormatTOML
+	}
+
+	return FormatYAML
+}
+
+// Convert a YAML or TOML config to JSON, so that all the formats are
+// read (and checked) the same way.
+func configJSON(format string, data []byte) ([]byte, error) {
+	var value interface{}
+
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		err := yaml.Unmarshal(data, &value)
+		if err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		var table map[string]interface{}
+		err := toml.Unmarshal(data, &table)
+		if err != nil {
+			return nil, err
+		}
+		value = table
+	default:
+		return nil, fmt.Errorf("unknown config format '%s'", format)
+	}
+
+	// an empty YAML file is an empty config
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,51 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigFormats(t *testing.T) {
+	expected, err := rgm.LoadConfig("testdata/config_full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the settings were read, not just equally missing
+	if expected.Prune != rgm.PruneArchive || time.Duration(expected.Remotes[0].Timeout) != 5*time.Minute ||
+		expected.Remotes[1].Credentials == nil || expected.Remotes[0].Names["python-requests"] != "python3-requests" {
+		t.Fatalf("unexpected config_full.json: %+v", expected)
+	}
+
+	// the ones without an extension are sniffed
+	for _, config := range []string{
+		"testdata/config_full.yaml",
+		"testdata/config_full.toml",
+		"testdata/config_full_yaml",
+		"testdata/config_full_toml",
+	} {
+		cfg, err := rgm.LoadConfig(config)
+		if err != nil {
+			t.Errorf("unable to load '%s': %v", config, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("'%s' differs from config_full.json:\n%+v\n%+v", config, cfg, expected)
+		}
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	_, err := rgm.LoadConfig("testdata/config_unknown.yaml")
+	if err == nil || !strings.Contains(err.Error(), "Remotes[0].Timout: unknown setting") {
+		t.Errorf("expected the unknown setting to be found: %v", err)
+	}
+
+	_, err = rgm.LoadConfig("testdata/patch.origin/HEAD")
+	if err == nil {
+		t.Errorf("expected a file that isn't a config to fail")
+	}
+}
@@ -0,0 +1,364 @@
+package rgm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Where the system wide config is looked for (config.json, ...).
+var SystemConfigDir = "/etc/rgm"
+
+// The extensions of the config files that are looked for, in order.
+var configExts = []string{".json", ".yaml", ".yml", ".toml"}
+
+// A setting of a config and the file it came from.
+//
+//	Remotes[0].URL  "https://src.fedoraproject.org/rpms/{{.RPM}}.git"  /etc/rgm/config.yaml
+type ConfigSetting struct {
+	Path   string
+	Value  interface{} // as it would be in JSON
+	Source string
+}
+
+// Find base with the first of the config extensions, "" if there
+// isn't one.
+func findConfigFile(base string) (string, error) {
+	for _, ext := range configExts {
+		_, err := os.Stat(base + ext)
+		if err == nil {
+			return base + ext, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// The config files to use when none is given, in the order they are
+// layered (the later ones override the earlier ones).
+//
+//	/etc/rgm/config.*               system
+//	$XDG_CONFIG_HOME/rgm/config.*   user (~/.config/rgm by default)
+//	./rgm.*                         project
+//	$RGM_CONFIG
+//
+// Each of them is optional, but $RGM_CONFIG must exist if it is set.
+func ConfigFiles() ([]string, error) {
+	bases := []string{filepath.Join(SystemConfigDir, "config")}
+	if dir, err := os.UserConfigDir(); err == nil {
+		bases = append(bases, filepath.Join(dir, "rgm", "config"))
+	}
+	bases = append(bases, "rgm")
+
+	var files []string
+	for _, base := range bases {
+		file, err := findConfigFile(base)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	if file := os.Getenv("RGM_CONFIG"); file != "" {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("unable to read $RGM_CONFIG: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// Load the layered config files from ConfigFiles.
+func LoadDefaultConfig() (Config, []ConfigSetting, error) {
+	files, err := ConfigFiles()
+	if err != nil {
+		return Config{}, nil, err
+	}
+	if len(files) == 0 {
+		return Config{}, nil, fmt.Errorf("no config found, looked for %s/config.*, $XDG_CONFIG_HOME/rgm/config.*, ./rgm.* and $RGM_CONFIG", SystemConfigDir)
+	}
+
+	return LoadConfigLayers(files)
+}
+
+// Load config files and merge them, each one overriding the ones
+// before it.  The settings are merged one by one, so a file only
+// needs the ones it changes, and the remotes are merged by their
+// Name (other lists, such as URLs, are replaced).
+//
+// Along with the merged config, each of its settings is returned
+// with the file it came from.  The merged config is checked with
+// Validate and each file for unknown settings.
+func LoadConfigLayers(files []string) (Config, []ConfigSetting, error) {
+	var cfg Config
+	var errs ConfigErrors
+	var merged interface{}
+	sources := make(map[string]string)
+	typ := reflect.TypeOf(cfg)
+
+	for _, file := range files {
+		data, err := readConfigJSON(file)
+		if err != nil {
+			return cfg, nil, err
+		}
+
+		// the types are checked on each file, so an error is
+		// reported along with the file it is in
+		var layer_cfg Config
+		err = json.Unmarshal(data, &layer_cfg)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("Unmarshal of '%s' failed: %v", file, err)
+		}
+		var layer interface{}
+		err = json.Unmarshal(data, &layer)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("Unmarshal of '%s' failed: %v", file, err)
+		}
+
+		var layer_errs ConfigErrors
+		checkKeys(&layer_errs, "", layer, typ)
+		for _, e := range layer_errs {
+			e.File = file
+			errs = append(errs, e)
+		}
+
+		merged = mergeLayer("", merged, layer, typ, file, sources)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return cfg, nil, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("Unmarshal of the merged config failed: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		for _, e := range err.(ConfigErrors) {
+			e.File = sourceOf(sources, e.Path)
+			if e.File == "" && len(files) == 1 {
+				e.File = files[0]
+			}
+			errs = append(errs, e)
+		}
+	}
+
+	settings := configSettings("", merged, typ, sources)
+	if len(errs) > 0 {
+		return cfg, settings, fmt.Errorf("invalid config:\n%w", errs)
+	}
+
+	return cfg, settings, nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// Whether a setting is under a path, e.g. Remotes[0].URL is under
+// Remotes[0] and Remotes.
+func underPath(setting string, path string) bool {
+	return strings.HasPrefix(setting, path+".") || strings.HasPrefix(setting, path+"[")
+}
+
+// Forget where the settings under a path came from, they were
+// replaced.
+func clearSources(sources map[string]string, path string) {
+	for setting := range sources {
+		if setting == path || path == "" || underPath(setting, path) {
+			delete(sources, setting)
+		}
+	}
+}
+
+// The file a setting came from, or for a group of settings (e.g.
+// Remotes[1]) the file of the first of them.
+func sourceOf(sources map[string]string, path string) string {
+	if file, ok := sources[path]; ok {
+		return file
+	}
+
+	first := ""
+	for setting := range sources {
+		if underPath(setting, path) && (first == "" || setting < first) {
+			first = setting
+		}
+	}
+
+	return sources[first]
+}
+
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// A list of structs with a Name, which are merged by name.
+func isNamedList(typ reflect.Type) bool {
+	if typ.Kind() != reflect.Slice {
+		return false
+	}
+	elem := typ.Elem()
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return false
+	}
+	_, ok := elem.FieldByName("Name")
+
+	return ok
+}
+
+// The Name of an element of a named list, "" if it has none.
+func elemName(value interface{}) string {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for key, name := range obj {
+		if strings.EqualFold(key, "Name") {
+			s, _ := name.(string)
+			return s
+		}
+	}
+
+	return ""
+}
+
+// Merge a layer (src) in to what was merged so far (dst), recording
+// the file each of the settings came from.
+func mergeLayer(path string, dst interface{}, src interface{}, typ reflect.Type, file string, sources map[string]string) interface{} {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch src := src.(type) {
+	case map[string]interface{}:
+		if typ.Kind() != reflect.Struct && typ.Kind() != reflect.Map {
+			break
+		}
+		dst_obj, ok := dst.(map[string]interface{})
+		if !ok {
+			clearSources(sources, path)
+			dst_obj = make(map[string]interface{})
+		}
+		for key, value := range src {
+			name := key
+			elem_typ := anyType
+			if typ.Kind() == reflect.Map {
+				elem_typ = typ.Elem()
+			} else if field, ok := lookupField(typ, key); ok {
+				// the same name whatever the case was
+				name = field.Name
+				elem_typ = field.Type
+			}
+			dst_obj[name] = mergeLayer(joinPath(path, name), dst_obj[name], value, elem_typ, file, sources)
+		}
+		return dst_obj
+	case []interface{}:
+		if !isNamedList(typ) {
+			break
+		}
+		dst_list, ok := dst.([]interface{})
+		if !ok {
+			clearSources(sources, path)
+		}
+		// only merge with the earlier layers, so two remotes with the
+		// same name in a file are still reported by Validate
+		earlier := len(dst_list)
+		merged := make(map[int]bool)
+		for _, value := range src {
+			i := -1
+			name := elemName(value)
+			for j := 0; j < earlier; j++ {
+				if name != "" && !merged[j] && elemName(dst_list[j]) == name {
+					i = j
+					merged[j] = true
+					break
+				}
+			}
+			if i < 0 {
+				dst_list = append(dst_list, nil)
+				i = len(dst_list) - 1
+			}
+			dst_list[i] = mergeLayer(fmt.Sprintf("%s[%d]", path, i), dst_list[i], value, typ.Elem(), file, sources)
+		}
+		return dst_list
+	}
+
+	// a value (or a list) replaces whatever was there
+	clearSources(sources, path)
+	sources[path] = file
+
+	return src
+}
+
+// The settings of a merged config in the order of the Config fields.
+func configSettings(path string, value interface{}, typ reflect.Type, sources map[string]string) []ConfigSetting {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if file, ok := sources[path]; ok {
+		return []ConfigSetting{{Path: path, Value: value, Source: file}}
+	}
+
+	var settings []ConfigSetting
+	switch value := value.(type) {
+	case map[string]interface{}:
+		var keys []string
+		types := make(map[string]reflect.Type)
+		if typ.Kind() == reflect.Struct {
+			for i := 0; i < typ.NumField(); i++ {
+				field := typ.Field(i)
+				if _, ok := value[field.Name]; ok {
+					keys = append(keys, field.Name)
+					types[field.Name] = field.Type
+				}
+			}
+		}
+		// the keys of a map and the unknown settings
+		var rest []string
+		for key := range value {
+			if _, ok := types[key]; !ok {
+				rest = append(rest, key)
+			}
+		}
+		sort.Strings(rest)
+		for _, key := range rest {
+			keys = append(keys, key)
+			if typ.Kind() == reflect.Map {
+				types[key] = typ.Elem()
+			} else {
+				types[key] = anyType
+			}
+		}
+
+		for _, key := range keys {
+			settings = append(settings, configSettings(joinPath(path, key), value[key], types[key], sources)...)
+		}
+	case []interface{}:
+		elem_typ := anyType
+		if typ.Kind() == reflect.Slice {
+			elem_typ = typ.Elem()
+		}
+		for i, elem := range value {
+			settings = append(settings, configSettings(fmt.Sprintf("%s[%d]", path, i), elem, elem_typ, sources)...)
+		}
+	}
+
+	return settings
+}
@@ -0,0 +1,198 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point the config search at empty temp dirs, returning the system,
+// user and project dirs.
+func configDirs(t *testing.T) (string, string, string) {
+	t.Helper()
+
+	tmp := t.TempDir()
+	system := filepath.Join(tmp, "etc")
+	user := filepath.Join(tmp, "home")
+	project := filepath.Join(tmp, "project")
+	for _, dir := range []string{system, filepath.Join(user, "rgm"), project} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old_system := rgm.SystemConfigDir
+	rgm.SystemConfigDir = system
+	t.Cleanup(func() { rgm.SystemConfigDir = old_system })
+	t.Setenv("XDG_CONFIG_HOME", user)
+	t.Setenv("RGM_CONFIG", "")
+
+	return system, user, project
+}
+
+func writeConfig(t *testing.T, path string, data string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("unable to write '%s': %v", path, err)
+	}
+}
+
+// Change to a dir until the end of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+}
+
+func TestConfigLayers(t *testing.T) {
+	system, user, project := configDirs(t)
+
+	writeConfig(t, filepath.Join(system, "config.yaml"), `
+Origin:
+  Name: origin
+  URL: "https://src.fedoraproject.org/rpms/{{.RPM}}.git"
+Remotes:
+  - Name: fedora
+    URL: "https://src.fedoraproject.org/rpms/{{.RPM}}.git"
+  - Name: centos
+    URL: "https://git.centos.org/rpms/{{.RPM}}.git"
+Retry: {Retries: 3, Backoff: 2s}
+`)
+	writeConfig(t, filepath.Join(user, "rgm", "config.toml"), `
+Prune = "archive"
+
+[Retry]
+Retries = 5
+`)
+	writeConfig(t, filepath.Join(project, "rgm.json"), `{
+  "Remotes": [
+    {"name": "centos", "URLs": ["https://mirror.example.com/centos/{{.RPM}}.git"]},
+    {"Name": "internal", "URL": "https://git.example.com/rpms/{{.RPM}}.git"}
+  ]
+}`)
+	env := filepath.Join(project, "env.json")
+	writeConfig(t, env, `{"Prune": "delete"}`)
+	t.Setenv("RGM_CONFIG", env)
+	chdir(t, project)
+
+	files, err := rgm.ConfigFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_files := []string{
+		filepath.Join(system, "config.yaml"),
+		filepath.Join(user, "rgm", "config.toml"),
+		"rgm.json",
+		env,
+	}
+	if strings.Join(files, " ") != strings.Join(expected_files, " ") {
+		t.Fatalf("expected the config files %v, got %v", expected_files, files)
+	}
+
+	cfg, settings, err := rgm.LoadDefaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Prune != rgm.PruneDelete || cfg.Retry.Retries != 5 || cfg.Retry.Backoff == 0 {
+		t.Errorf("unexpected merged settings: %+v", cfg)
+	}
+	if len(cfg.Remotes) != 3 {
+		t.Fatalf("expected 3 remotes, got %+v", cfg.Remotes)
+	}
+	centos := cfg.Remotes[1]
+	if centos.Name != "centos" || centos.URL == "" || len(centos.URLs) != 1 {
+		t.Errorf("expected centos to be merged: %+v", centos)
+	}
+	if cfg.Remotes[2].Name != "internal" {
+		t.Errorf("expected internal to be added: %+v", cfg.Remotes[2])
+	}
+
+	sources := make(map[string]string)
+	for _, setting := range settings {
+		sources[setting.Path] = setting.Source
+	}
+	for path, file := range map[string]string{
+		"Origin.URL":         expected_files[0],
+		"Remotes[1].URL":     expected_files[0],
+		"Remotes[1].URLs":    "rgm.json",
+		"Remotes[2].URL":     "rgm.json",
+		"Retry.Retries":      expected_files[1],
+		"Retry.Backoff":      expected_files[0],
+		"Prune":              env,
+		"Remotes[0].Timeout": "",
+	} {
+		if sources[path] != file {
+			t.Errorf("expected '%s' from '%s', got '%s'", path, file, sources[path])
+		}
+	}
+}
+
+func TestConfigLayersErrors(t *testing.T) {
+	system, _, project := configDirs(t)
+	chdir(t, project)
+
+	_, _, err := rgm.LoadDefaultConfig()
+	if err == nil || !strings.Contains(err.Error(), "no config found") {
+		t.Errorf("expected no config to be found: %v", err)
+	}
+
+	// the problems are reported with the file they are in
+	writeConfig(t, filepath.Join(system, "config.json"), `{
+  "Origin": {"Name": "origin", "URL": "https://src.fedoraproject.org/rpms/{{.RPM}}.git"},
+  "Remotes": [{"Name": "fedora", "URL": "https://src.fedoraproject.org/rpms/{{.RPM}}.git"}]
+}`)
+	writeConfig(t, "rgm.yaml", `
+Remotes:
+  - Name: origin
+    URL: "https://git.example.com/{{.RPM}}.git"
+    Timout: 5m
+`)
+	_, _, err = rgm.LoadDefaultConfig()
+	if err == nil {
+		t.Fatalf("expected the duplicate origin to fail")
+	}
+	for _, msg := range []string{
+		"rgm.yaml: Remotes[0].Timout: unknown setting",
+		"rgm.yaml: Remotes[1].Name: 'origin' is already the name of Origin",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected '%s' in: %v", msg, err)
+		}
+	}
+
+	t.Setenv("RGM_CONFIG", filepath.Join(project, "missing.json"))
+	_, err = rgm.ConfigFiles()
+	if err == nil {
+		t.Errorf("expected a missing $RGM_CONFIG to fail")
+	}
+}
+
+func TestRpmMirrorDefaultConfig(t *testing.T) {
+	configDirs(t)
+
+	config, err := filepath.Abs("testdata/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RGM_CONFIG", config)
+
+	dir := t.TempDir()
+	_, err = rgm.RpmMirror("", "patch", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRefExists(t, dir, "refs/heads/fedora/f31", true)
+}
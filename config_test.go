@@ -1,9 +1,11 @@
 package rgm_test
 
 import (
+	"encoding/json"
 	"github.com/jmahler/rgm"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -34,3 +36,103 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("Filled out template '%s' missing rpm '%s'", url, rpm)
 	}
 }
+
+func TestConfigURLs(t *testing.T) {
+	cfg_tmpl, err := rgm.LoadConfig("testdata/config_urls.json")
+	if err != nil {
+		t.Fatalf("Failed to load config_urls.json: %v", err)
+	}
+
+	cfg, err := rgm.ExecConfigTemplate(cfg_tmpl, "patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the template shouldn't be modified
+	if cfg_tmpl.Remotes[0].URLs[1] != "testdata/{{.RPM}}.fedora" {
+		t.Errorf("ExecConfigTemplate corrupted the template: '%s'", cfg_tmpl.Remotes[0].URLs[1])
+	}
+
+	cases := []struct {
+		Remote rgm.RemoteConfig
+		URLs   []string
+	}{
+		{cfg.Origin, []string{"testdata/patch.missing", "testdata/patch.origin"}},
+		{cfg.Remotes[0], []string{"testdata/patch.missing", "testdata/patch.fedora"}},
+		{cfg.Remotes[1], []string{"testdata/patch.centos", "testdata/patch.missing"}},
+	}
+	for _, c := range cases {
+		urls := c.Remote.CandidateURLs()
+		if strings.Join(urls, " ") != strings.Join(c.URLs, " ") {
+			t.Errorf("remote '%s' expected URLs %v, got %v", c.Remote.Name, c.URLs, urls)
+		}
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	var rc rgm.RemoteConfig
+
+	err := json.Unmarshal([]byte(`{"Name": "centos", "Timeout": "1m30s"}`), &rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(rc.Timeout) != 90*time.Second {
+		t.Errorf("expected a 90s timeout, got %v", time.Duration(rc.Timeout))
+	}
+
+	err = json.Unmarshal([]byte(`{"Name": "centos", "Timeout": "soon"}`), &rc)
+	if err == nil {
+		t.Errorf("bad timeout should've failed")
+	}
+}
+
+func TestConfigTemplateData(t *testing.T) {
+	t.Setenv("RGM_TEST_HOST", "git.example.com")
+
+	cases := []struct {
+		URL      string
+		RPM      string
+		Expected string
+	}{
+		{"{{.RPM}}", "patch", "patch"},
+		{"/rpms/{{.RPM | first}}/{{.RPM}}", "patch", "/rpms/p/patch"},
+		{"{{.RPM | lower}}", "GConf2", "gconf2"},
+		{"{{.RPM | urlquery}}", "gtk+", "gtk%2B"},
+		{"https://{{env \"RGM_TEST_HOST\"}}/{{.RPM}}", "patch", "https://git.example.com/patch"},
+		{"{{.Remote}}/{{.Name}}", "python-requests", "fedora/python3-requests"},
+		{"{{.Remote}}/{{.Name}}", "patch", "fedora/patch"},
+	}
+
+	for _, c := range cases {
+		cfg := rgm.Config{
+			Remotes: []rgm.RemoteConfig{{
+				Name:  "fedora",
+				URL:   c.URL,
+				Names: map[string]string{"python-requests": "python3-requests"},
+			}},
+		}
+		cfg, err := rgm.ExecConfigTemplate(cfg, c.RPM)
+		if err != nil {
+			t.Errorf("'%s' failed: %v", c.URL, err)
+			continue
+		}
+		if cfg.Remotes[0].URL != c.Expected {
+			t.Errorf("'%s' expected '%s', got '%s'", c.URL, c.Expected, cfg.Remotes[0].URL)
+		}
+	}
+
+	cfg := rgm.Config{
+		Remotes: []rgm.RemoteConfig{{Name: "fedora", URL: "https://{{env \"RGM_TEST_UNSET\"}}/{{.RPM}}"}},
+	}
+	_, err := rgm.ExecConfigTemplate(cfg, "patch")
+	if err == nil || !strings.Contains(err.Error(), "RGM_TEST_UNSET") {
+		t.Errorf("expected an unset environment variable to fail: %v", err)
+	}
+}
+
+func TestConfigBadTemplate(t *testing.T) {
+	_, err := rgm.LoadConfig("testdata/config_bad_template.json")
+	if err == nil || !strings.Contains(err.Error(), "Remotes[0].URL: ") {
+		t.Errorf("expected the bad template of fedora to fail at load time: %v", err)
+	}
+}
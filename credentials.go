@@ -0,0 +1,193 @@
+package rgm
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How to authenticate to a remote, for example a private dist-git.
+//
+//	"Credentials": {"SSHKey": "~/.ssh/id_rsa"}
+//	"Credentials": {"SSHAgent": true}
+//	"Credentials": {"Username": "mirror", "PasswordEnv": "DISTGIT_TOKEN"}
+//	"Credentials": {"Netrc": true}
+//
+// Secrets are never kept in the config itself, they come from the
+// environment, the ssh-agent or the netrc file.
+type CredentialsConfig struct {
+	// User name for SSH or HTTP, the one in the URL is used if
+	// it isn't set.
+	Username string
+	// Private SSH key, with the public key next to it (.pub).
+	SSHKey string
+	// Environment variable with the passphrase of the SSHKey.
+	SSHPassphraseEnv string
+	// Use the keys of the running ssh-agent.
+	SSHAgent bool
+	// Environment variable with the HTTP password or token.
+	PasswordEnv string
+	// Look up the HTTP login in ~/.netrc (or $NETRC).
+	Netrc bool
+}
+
+// libgit2 keeps asking for credentials as long as they are rejected,
+// so give up after a few tries.
+const maxCredentialAttempts = 3
+
+// An entry of a netrc file.
+type netrcEntry struct {
+	Login    string
+	Password string
+}
+
+// Get the path to the netrc file, $NETRC or ~/.netrc.
+func netrcPath() (string, error) {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// Find the login for a host in a netrc file, falling back to the
+// default entry if there is one.  The body of a macdef goes on up to
+// the next blank line and is skipped.
+//
+//	machine src.example.com login mirror password s3cret
+//	default login anonymous password guest
+func lookupNetrc(path string, host string) (*netrcEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read netrc '%s': %v", path, err)
+	}
+	defer file.Close()
+
+	var tokens []string
+	macdef := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if macdef {
+			macdef = line != ""
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			// macdef <name>, the macro starts on the next line
+			if len(tokens) > 0 && tokens[len(tokens)-1] == "macdef" {
+				tokens = append(tokens, field)
+				macdef = true
+				break
+			}
+			tokens = append(tokens, field)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read netrc '%s': %v", path, err)
+	}
+
+	var found, fallback *netrcEntry
+	var entry *netrcEntry
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			entry = nil
+			if i+1 < len(tokens) {
+				i++
+				if tokens[i] == host && found == nil {
+					found = &netrcEntry{}
+					entry = found
+				}
+			}
+		case "default":
+			entry = nil
+			if fallback == nil {
+				fallback = &netrcEntry{}
+				entry = fallback
+			}
+		case "login", "password", "account", "macdef":
+			if i+1 >= len(tokens) {
+				break
+			}
+			i++
+			if entry == nil {
+				continue
+			}
+			if tokens[i-1] == "login" {
+				entry.Login = tokens[i]
+			} else if tokens[i-1] == "password" {
+				entry.Password = tokens[i]
+			}
+		}
+	}
+
+	if found != nil {
+		return found, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, fmt.Errorf("no entry for '%s' in netrc '%s'", host, path)
+}
+
+// Expand a leading ~/ to the home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[2:])
+}
+
+// Get the HTTP user and password for a URL from the environment or
+// the netrc file.
+func (cc *CredentialsConfig) userpass(remote_url string, username string) (string, string, error) {
+	if cc.PasswordEnv != "" {
+		password := os.Getenv(cc.PasswordEnv)
+		if password == "" {
+			return "", "", fmt.Errorf("environment variable '%s' isn't set", cc.PasswordEnv)
+		}
+		if username == "" {
+			// token auth usually doesn't care about the user
+			username = "git"
+		}
+		return username, password, nil
+	}
+
+	if cc.Netrc {
+		u, err := url.Parse(remote_url)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to parse URL '%s': %v", remote_url, err)
+		}
+		path, err := netrcPath()
+		if err != nil {
+			return "", "", err
+		}
+		entry, err := lookupNetrc(path, u.Hostname())
+		if err != nil {
+			return "", "", err
+		}
+		if username == "" {
+			username = entry.Login
+		}
+		return username, entry.Password, nil
+	}
+
+	return "", "", fmt.Errorf("no HTTP credentials configured")
+}
@@ -0,0 +1,98 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Serve the testdata repos over http, only to the given user.
+func authServer(t *testing.T, user string, password string) *httptest.Server {
+	t.Helper()
+
+	backend := gitBackend(t)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dist-git"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+}
+
+func TestRpmMirrorCredentials(t *testing.T) {
+	server := authServer(t, "mirror", "s3cret")
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	netrc := filepath.Join(tmp, "netrc")
+	// the body of the macdef isn't an entry, it ends at the blank line
+	err = ioutil.WriteFile(netrc, []byte("machine other.example.com login nobody password nothing macdef init\n"+
+		"machine "+u.Hostname()+" login mirror password wrong\n\n"+
+		"machine "+u.Hostname()+"\n  login mirror\n  password s3cret\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write netrc: %v", err)
+	}
+	os.Setenv("NETRC", netrc)
+	defer os.Unsetenv("NETRC")
+
+	os.Setenv("RGM_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("RGM_TEST_TOKEN")
+	os.Setenv("RGM_TEST_BAD_TOKEN", "wrong")
+	defer os.Unsetenv("RGM_TEST_BAD_TOKEN")
+
+	cases := []struct {
+		Name        string
+		Credentials *rgm.CredentialsConfig
+		Fetched     bool
+	}{
+		{"none", nil, false},
+		{"password env", &rgm.CredentialsConfig{Username: "mirror", PasswordEnv: "RGM_TEST_TOKEN"}, true},
+		{"wrong password", &rgm.CredentialsConfig{Username: "mirror", PasswordEnv: "RGM_TEST_BAD_TOKEN"}, false},
+		{"unset env", &rgm.CredentialsConfig{Username: "mirror", PasswordEnv: "RGM_TEST_UNSET"}, false},
+		{"netrc", &rgm.CredentialsConfig{Netrc: true}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(tmp, "mirror")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+
+			cfg := rgm.Config{
+				Origin: rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+				Remotes: []rgm.RemoteConfig{
+					{Name: "fedora", URL: server.URL + "/{{.RPM}}.fedora", Credentials: c.Credentials},
+					{Name: "centos", URL: "testdata/{{.RPM}}.centos"},
+				},
+			}
+
+			_, err = rgm.RpmMirrorConfig(cfg, "patch", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testRefExists(t, dir, "refs/heads/fedora/f31", c.Fetched)
+			testRefExists(t, dir, "refs/heads/centos/c7", true)
+		})
+	}
+}
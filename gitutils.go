@@ -1,32 +1,103 @@
 package rgm
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/libgit2/git2go"
-	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 type RemoteConfig struct {
 	Name string
 	URL  string
+	// Alternative URLs (e.g. a primary mirror and then a fallback)
+	// that are tried in order after URL until one answers.
+	URLs []string
+	// The names of RPMs that are named differently on this remote,
+	// for {{.Name}} in the URLs.
+	//
+	//   "Names": {"python-requests": "python3-requests"}
+	Names map[string]string
+	// The branches of the remote to mirror, as globs ("f3*") or
+	// regular expressions between slashes ("/^c[0-9]+$/").  Without
+	// IncludeBranches all of them are, other than the excluded ones.
+	// They only apply to fetches, a new mirror is cloned from the
+	// origin with all of its branches.
+	//
+	//   "IncludeBranches": ["/^c[0-9]+s?$/"],
+	//   "ExcludeBranches": ["c4", "c5", "private-*"]
+	IncludeBranches []string
+	ExcludeBranches []string
+	// The template of the local branch names, with {{.Remote}} and
+	// {{.Branch}} (see TemplateData), "{{.Remote}}/{{.Branch}}" if
+	// it isn't set.
+	//
+	//   "BranchName": "dist/{{.Remote}}/{{.Branch | trimPrefix \"f\"}}"
+	//
+	// Changing it doesn't rename the branches that were named by the
+	// old one, they are left behind and no longer updated.
+	BranchName string
+	// The template of the URL of a source in the lookaside cache of
+	// the remote, see Mirror.Sources and TemplateData.
+	//
+	//   "Lookaside": "https://src.fedoraproject.org/repo/pkgs/{{.Name}}/{{.Filename}}/{{.HashType}}/{{.Hash}}/{{.Filename}}"
+	Lookaside string
+	// How long to wait on the remote (e.g. "5m") before the fetch
+	// is stopped.  No limit if it isn't set.
+	Timeout Duration
+	// Retries of a failed fetch, clone or download, instead of the
+	// global Retry of the Config.
+	Retry *RetryConfig
+	// How to authenticate, for remotes that need it.
+	Credentials *CredentialsConfig
 }
 
-// For an existing Git repo and an RPM (e.g. cowsay) Setup the remotes.
-//
-// This is a best effort procedure.  Not all remotes will be available
-// (fedora might not have package x).  As long as at least one remote
-// works it is a success.
-func SetupRpmRemotes(repo *git.Repository, rcs []RemoteConfig) error {
+// The retry settings of the remote, none if it doesn't have any.
+func (rc *RemoteConfig) retryConfig() RetryConfig {
+	if rc.Retry == nil {
+		return RetryConfig{}
+	}
+
+	return *rc.Retry
+}
+
+// All the URLs for a remote in the order they should be tried.
+func (rc *RemoteConfig) CandidateURLs() []string {
+	var urls []string
+	if rc.URL != "" {
+		urls = append(urls, rc.URL)
+	}
+	for _, url := range rc.URLs {
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+func setupRpmRemotes(ctx context.Context, repo repository, rcs []RemoteConfig, run *mirrorRun) error {
 
 	var one_worked bool = false
 
-	for _, rc := range rcs {
+	for i := range rcs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		// try to set up the remote, continue if it doesn't work
-		err := setupRpmRemote(repo, &rc)
+		err := setupRpmRemote(ctx, repo, &rcs[i], run)
+		if errors.Is(err, errAbandoned) {
+			return err
+		}
+		if err == nil {
+			err = setupRemoteTags(repo, rcs[i].Name)
+		}
 		if err != nil {
-			log.Println(err)
+			run.logger().Warn("unable to setup remote", "remote", rcs[i].Name, "err", err)
+			run.remote(rcs[i].Name).Error = err.Error()
 		} else {
 			one_worked = true
 		}
@@ -39,34 +110,299 @@ func SetupRpmRemotes(repo *git.Repository, rcs []RemoteConfig) error {
 	}
 }
 
-func setupRpmRemote(repo *git.Repository, cfg *RemoteConfig) error {
-	_, err := repo.Remotes.Create(cfg.Name, cfg.URL)
+// The operation didn't stop when it was told to and may still be
+// running, so the mirror can't go on.
+var errAbandoned = errors.New("abandoned")
+
+// How long an operation gets to stop after its context is done
+// before it is abandoned.
+const stopTimeout = 10 * time.Second
+
+// Run a network operation (fetch, clone, ...), stopping it when the
+// context is done or the timeout (if any) has passed.
+//
+// The operation gets the context and stops when it is done, but
+// libgit2 can't interrupt an operation that is blocked on the
+// network.  So it is run on its own and after the context is done
+// it is waited for up to stopTimeout, then it is abandoned
+// (errAbandoned).  An abandoned operation may still be writing to the
+// repo, so the caller must fail the whole mirror instead of going on.
+// The operation must not share any libgit2 objects with the caller
+// (e.g. open its own handle of the repo) since it may still be
+// running after this returns.
+func runContext(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	stop := time.NewTimer(stopTimeout)
+	defer stop.Stop()
+
+	select {
+	case <-done:
+		// it stopped, because of the context
+		return ctx.Err()
+	case <-stop.C:
+		return fmt.Errorf("%w: %v", errAbandoned, ctx.Err())
+	}
+}
+
+// Check that a URL answers by connecting to it without fetching.
+func probeURL(ctx context.Context, repo repository, url string, rc *RemoteConfig, run *mirrorRun) error {
+	return runContext(ctx, time.Duration(rc.Timeout), func(ctx context.Context) error {
+		handle, err := repo.Reopen()
+		if err != nil {
+			return err
+		}
+		defer handle.Free()
+
+		return handle.Probe(ctx, url, newFetchOptions(rc, run))
+	})
+}
+
+// Try each of the candidate URLs in order and return the first one
+// that answers.  With only one candidate there is nothing to choose
+// so it is returned as is.
+func findRemoteURL(ctx context.Context, repo repository, cfg *RemoteConfig, run *mirrorRun) (string, error) {
+	urls := cfg.CandidateURLs()
+	if len(urls) == 0 {
+		return "", fmt.Errorf("no URL for remote '%v'", cfg.Name)
+	}
+	if len(urls) == 1 {
+		return urls[0], nil
+	}
+
+	for _, url := range urls {
+		err := probeURL(ctx, repo, url, cfg, run)
+		if err == nil {
+			return url, nil
+		}
+		if errors.Is(err, errAbandoned) {
+			return "", fmt.Errorf("probe of '%s' %w", url, err)
+		}
+		run.logger().Warn("remote URL failed", "remote", cfg.Name, "url", url, "err", err)
+	}
+
+	return "", fmt.Errorf("none of the URLs for remote '%v' answered", cfg.Name)
+}
+
+// Add the remote if it is missing or update its URL if the config
+// has changed since the repo was last mirrored.
+func setupRpmRemote(ctx context.Context, repo repository, cfg *RemoteConfig, run *mirrorRun) error {
+	url, err := findRemoteURL(ctx, repo, cfg, run)
+	if err != nil {
+		return err
+	}
+	cfg.URL = url
+
+	rr := run.remote(cfg.Name)
+	rr.URL = url
+	rr.Configured = true
+
+	remote_url, err := repo.RemoteURL(cfg.Name)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			return fmt.Errorf("unable to lookup remote '%v': %v", cfg.Name, err)
+		}
+
+		err = repo.CreateRemote(cfg.Name, cfg.URL)
+		if err != nil {
+			return fmt.Errorf("git add remote for '%v' failed: %v", cfg.Name, err)
+		}
+
+		return nil
+	}
+
+	if remote_url != cfg.URL {
+		err = repo.SetRemoteURL(cfg.Name, cfg.URL)
+		if err != nil {
+			return fmt.Errorf("git set-url for '%v' failed: %v", cfg.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Fetch the tags of a remote in to their own namespace so that tags
+// from different distros don't collide and can be compared.
+//
+//	refs/tags/fedora/*
+//	refs/tags/centos/*
+//
+// Auto-following of tags is turned off for the remote, otherwise
+// they would still end up in refs/tags/ too.
+func setupRemoteTags(repo repository, name string) error {
+	refspecs, err := repo.FetchRefspecs(name)
+	if err != nil {
+		return fmt.Errorf("unable to get refspecs of remote '%v': %v", name, err)
+	}
+
+	tags_refspec := fmt.Sprintf("+refs/tags/*:refs/tags/%s/*", name)
+
+	found := false
+	for _, refspec := range refspecs {
+		if refspec == tags_refspec {
+			found = true
+			break
+		}
+	}
+	if !found {
+		err = repo.AddFetchRefspec(name, tags_refspec)
+		if err != nil {
+			return fmt.Errorf("unable to add tags refspec to remote '%v': %v", name, err)
+		}
+	}
+
+	err = repo.SetNoTags(name)
+	if err != nil {
+		return fmt.Errorf("Failed to set config tagopt: %v", err)
+	}
+
+	return nil
+}
+
+// Fetch a single remote, giving up after its timeout (if any) and
+// retrying transient failures.
+func fetchRemote(ctx context.Context, repo repository, name string, rc *RemoteConfig, run *mirrorRun) error {
+	fetch := func() error {
+		return runContext(ctx, time.Duration(rc.Timeout), func(ctx context.Context) error {
+			handle, err := repo.Reopen()
+			if err != nil {
+				return err
+			}
+			defer handle.Free()
+
+			filter, err := rc.branchFilter()
+			if err != nil {
+				return err
+			}
+			if filter != nil {
+				return fetchFiltered(ctx, handle, name, filter, newFetchOptions(rc, run))
+			}
+
+			return handle.Fetch(ctx, name, newFetchOptions(rc, run))
+		})
+	}
+
+	return withRetry(ctx, run.logger(), rc.retryConfig(), fmt.Sprintf("git fetch remote '%v'", name), fetch)
+}
+
+// Fetch only the branches of a remote that pass its filter.  The
+// patterns can't be written as refspecs, so the branches are listed
+// first and each one that passes is fetched by name, along with the
+// other (e.g. tags) refspecs of the remote.
+//
+//	+refs/heads/f31:refs/remotes/fedora/f31
+//	+refs/tags/*:refs/tags/fedora/*
+//
+// When no refspec is left there is nothing to fetch (a fetch without
+// refspecs would fetch the default ones, every branch).  A fetch of
+// named branches doesn't prune the ones that are gone, so when pruning
+// is on they are removed here.
+func fetchFiltered(ctx context.Context, repo repository, name string, filter *branchFilter, opts fetchOptions) error {
+	upstream, err := repo.RemoteBranches(ctx, name, opts)
 	if err != nil {
-		return fmt.Errorf("git add remote for '%v' failed: %v", cfg.Name, err)
+		return fmt.Errorf("unable to list branches: %v", err)
+	}
+
+	refspecs, err := repo.FetchRefspecs(name)
+	if err != nil {
+		return fmt.Errorf("unable to get refspecs: %v", err)
+	}
+	for _, refspec := range refspecs {
+		if !strings.HasPrefix(strings.TrimPrefix(refspec, "+"), "refs/heads/") {
+			opts.refspecs = append(opts.refspecs, refspec)
+		}
+	}
+	exists := make(map[string]bool)
+	for _, branch := range upstream {
+		exists[branch] = true
+		if filter.match(branch) {
+			opts.refspecs = append(opts.refspecs, fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, name, branch))
+		}
+	}
+
+	if len(opts.refspecs) > 0 {
+		err = repo.Fetch(ctx, name, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	prune, err := repo.FetchPrune()
+	if err != nil || !prune {
+		return err
+	}
+	branches, err := repo.Branches(remoteBranch)
+	if err != nil {
+		return err
+	}
+	for _, branch := range branches { // fedora/f29
+		short_branch := strings.TrimPrefix(branch, name+"/")
+		if short_branch == branch || short_branch == "HEAD" || exists[short_branch] {
+			continue
+		}
+		err = repo.DeleteRef("refs/remotes/" + branch)
+		if err != nil {
+			return fmt.Errorf("unable to prune '%s': %v", branch, err)
+		}
 	}
 
 	return nil
 }
 
-func FetchAll(repo *git.Repository) error {
+func fetchAll(ctx context.Context, repo repository, rcs []RemoteConfig, run *mirrorRun) error {
 	var one_worked bool = false
 
-	remotes, err := repo.Remotes.List()
+	settings := make(map[string]*RemoteConfig)
+	for i := range rcs {
+		settings[rcs[i].Name] = &rcs[i]
+	}
+
+	remotes, err := repo.Remotes()
 	if err != nil {
 		return fmt.Errorf("unable to list remotes: %v", err)
 	}
 
 	for _, remote := range remotes {
-		r, err := repo.Remotes.Lookup(remote) // get Remote obj
-		if err != nil {
-			log.Printf("unable to find remote '%v': %v", remote, err)
-			continue
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		err = r.Fetch(nil, nil, "")
+		rc, ok := settings[remote]
+		if !ok {
+			rc = &RemoteConfig{Name: remote}
+		}
+
+		start := time.Now()
+		err = fetchRemote(ctx, repo, remote, rc, run)
+
+		rr := run.remote(remote)
+		rr.FetchTime = Duration(time.Since(start))
+		if errors.Is(err, errAbandoned) {
+			// it may still be fetching in to the repo
+			err = fmt.Errorf("git fetch remote '%v' %w", remote, err)
+			rr.Error = err.Error()
+			return err
+		}
 		if err != nil {
-			log.Printf("git fetch remote '%v' failed: %v", remote, err)
+			run.logger().Warn("git fetch failed", "remote", remote, "err", err)
+			rr.Error = fmt.Sprintf("git fetch remote '%v' failed: %v", remote, err)
 		} else {
+			rr.Fetched = true
 			one_worked = true
 		}
 	}
@@ -78,67 +414,176 @@ func FetchAll(repo *git.Repository) error {
 	}
 }
 
+// A local branch and the branch of a remote that it mirrors.
+//
+//	dist/fedora/31 -> remotes/fedora/f31
+type branchMapping struct {
+	local  string // dist/fedora/31
+	remote string // fedora
+	branch string // f31
+}
+
+// The name of the remote-tracking branch, e.g. fedora/f31.
+func (bm branchMapping) tracking() string {
+	return bm.remote + "/" + bm.branch
+}
+
+// The name of the local branch for a branch of the remote, from its
+// BranchName.
+//
+//	f31 -> fedora/f31
+func (rc *RemoteConfig) localBranchName(branch string) (string, error) {
+	if rc.BranchName == "" {
+		return rc.Name + "/" + branch, nil
+	}
+
+	tmpl, err := parseTemplate(rc.BranchName)
+	if err != nil {
+		return "", err
+	}
+	out := new(strings.Builder)
+	err = tmpl.Execute(out, TemplateData{Remote: rc.Name, Branch: branch})
+	if err != nil {
+		return "", fmt.Errorf("unable to exec template '%s' for '%s': %v", rc.BranchName, branch, err)
+	}
+
+	name := out.String()
+	if !validBranchName(name) {
+		return "", fmt.Errorf("'%s' of template '%s' for '%s' isn't a valid branch name", name, rc.BranchName, branch)
+	}
+
+	return name, nil
+}
+
 // For a repo with remote branches the expected local branch name
-// is the same but with "remotes/" removed.
-//  remotes/fedora/f31 -> fedora/31
+// is the one given by the BranchName of the remote, by default the
+// same but with "remotes/" removed.
+//
+//	remotes/fedora/f31 -> fedora/f31
+//
 // This gets the set of local branches (e.g. fedora/f31) that "should"
-// exist based on the remotes that were found.
-func getExpectedLocalBranches(repo *git.Repository) ([]string, error) {
+// exist based on the remotes that were found, leaving out the ones
+// that don't pass the branch filter of their remote in rcs.
+func getExpectedLocalBranches(repo repository, rcs []RemoteConfig) ([]branchMapping, error) {
 
-	var branches []string
-	iter, err := repo.NewBranchIterator(git.BranchRemote)
+	filters, err := branchFilters(rcs)
 	if err != nil {
 		return nil, err
 	}
-	defer iter.Free()
-	for {
-		ref, branch_type, err := iter.Next()
-		if err != nil {
-			break
+	settings := make(map[string]*RemoteConfig)
+	for i := range rcs {
+		settings[rcs[i].Name] = &rcs[i]
+	}
+
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []branchMapping
+	locals := make(map[string]string)
+	remote_branches, err := repo.Branches(remoteBranch)
+	if err != nil {
+		return nil, err
+	}
+	for _, tracking := range remote_branches { // fedora/f31
+		// the longest remote that the branch is under
+		bm := branchMapping{}
+		for _, remote := range remotes {
+			if strings.HasPrefix(tracking, remote+"/") && len(remote) > len(bm.remote) {
+				bm.remote = remote
+				bm.branch = strings.TrimPrefix(tracking, remote+"/")
+			}
 		}
-		if branch_type != git.BranchRemote {
+		// exclude special branch refs like HEAD, and the ones of
+		// remotes that are gone
+		if bm.remote == "" || bm.branch == "HEAD" {
 			continue
 		}
-		branch, _ := ref.Branch().Name() // fedora/f31
-		// exclude special branch refs like HEAD
-		if branch == "origin/HEAD" {
+		if filter, ok := filters[bm.remote]; ok && !filter.match(bm.branch) {
 			continue
 		}
-		branches = append(branches, branch)
+
+		rc, ok := settings[bm.remote]
+		if !ok {
+			rc = &RemoteConfig{Name: bm.remote}
+		}
+		bm.local, err = rc.localBranchName(bm.branch)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := locals[bm.local]; ok {
+			return nil, fmt.Errorf("both '%s' and '%s' would be the local branch '%s'", other, tracking, bm.local)
+		}
+		locals[bm.local] = tracking
+
+		branches = append(branches, bm)
 	}
 
 	return branches, nil
 }
 
-func setupRpmBranch(repo *git.Repository, branch string) error {
+// Whether a local branch already tracks something other than its
+// remote branch (e.g. a branch of the user that happens to have the
+// same name), and what, "" if it doesn't.
+func upstreamConflict(repo repository, bm branchMapping) (string, error) {
+	remote, merge, err := repo.Upstream(bm.local)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the upstream of '%s': %v", bm.local, err)
+	}
+	if remote != "" && (remote != bm.remote || merge != "refs/heads/"+bm.branch) {
+		return fmt.Sprintf("branch '%s' already tracks '%s' of '%s', not '%s'", bm.local, merge, remote, bm.tracking()), nil
+	}
+
+	return "", nil
+}
+
+// A branch with a conflicting upstream is left alone, the other
+// branches are still set up and updated.
+func reportConflict(run *mirrorRun, bm branchMapping, conflict string) {
+	run.logger().Warn("branch tracks another upstream, left alone", "branch", bm.local, "err", conflict)
 
-	var err error
+	br := run.branch(bm.local)
+	br.Status = BranchConflict
+	br.Error = conflict
+	run.branchUpdate(br)
+}
+
+func setupRpmBranch(repo repository, bm branchMapping, run *mirrorRun) error {
 
 	// first, lookup the remote branch and create a local one if needed
 
-	local_branch, err := repo.LookupBranch(branch, git.BranchLocal)
-	if local_branch == nil || err != nil {
-		remote_branch, err := repo.LookupBranch(branch, git.BranchRemote)
+	_, err := repo.BranchTarget(bm.local, localBranch)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			return fmt.Errorf("unable to lookup branch '%s': %v", bm.local, err)
+		}
+
+		target, err := repo.BranchTarget(bm.tracking(), remoteBranch)
 		if err != nil {
-			return fmt.Errorf("unable to find remote '%s': %v", branch, err)
+			return fmt.Errorf("unable to find remote '%s': %v", bm.tracking(), err)
 		}
-		defer remote_branch.Free()
 
-		commit, err := repo.LookupCommit(remote_branch.Target())
+		err = repo.CreateBranch(bm.local, target)
 		if err != nil {
-			return fmt.Errorf("lookup commit failed: %v", err)
+			return fmt.Errorf("create branch '%s' failed: %v", bm.local, err)
 		}
-		defer commit.Free()
 
-		local_branch, err = repo.CreateBranch(branch, commit, false)
+		br := run.branch(bm.local)
+		br.Status = BranchCreated
+		br.NewOid = target
+		run.branchUpdate(br)
+	} else {
+		// don't take over a branch that tracks something else
+		conflict, err := upstreamConflict(repo, bm)
 		if err != nil {
-			return fmt.Errorf("create branch '%s' failed: %v", branch, err)
+			return err
+		}
+		if conflict != "" {
+			reportConflict(run, bm, conflict)
+			return nil
 		}
 	}
-	if local_branch == nil {
-		return fmt.Errorf("Failed to create local branch '%v'.", branch)
-	}
-	defer local_branch.Free()
 
 	// second, --set-upstream tracking branch
 
@@ -152,166 +597,434 @@ func setupRpmBranch(repo *git.Repository, branch string) error {
 	// git config "branch.fedora/f31.remote" fedora
 	// git config "branch.fedora/f31.merge" "refs/heads/f31"
 
-	branch_parts := strings.Split(branch, "/")
-	remote := branch_parts[0]                           // fedora
-	short_branch := strings.Join(branch_parts[1:], "/") // f31
+	return repo.SetUpstream(bm.local, bm.remote, "refs/heads/"+bm.branch)
+}
+
+// What to do with a local branch whose upstream branch is gone.
+type PrunePolicy string
 
-	cfg, err := repo.Config()
+const (
+	PruneNone    PrunePolicy = ""        // keep the branch
+	PruneDelete  PrunePolicy = "delete"  // delete the branch
+	PruneArchive PrunePolicy = "archive" // move it to refs/archive/
+)
+
+// Turn pruning of dead remote-tracking refs on or off for every
+// remote.  FetchAll then prunes like a `git fetch --prune`.
+func setupPrune(repo repository, policy PrunePolicy) error {
+	err := repo.SetFetchPrune(policy != PruneNone)
 	if err != nil {
-		return fmt.Errorf("Failed to get Config: %v", err)
+		return fmt.Errorf("Failed to set config fetch.prune: %v", err)
 	}
-	err = cfg.SetString(fmt.Sprintf("branch.%s.remote", branch), remote)
+
+	return nil
+}
+
+// Get the remote-tracking ref that a local branch was set up to
+// track, or "" if it doesn't track a remote.  A branch can also track
+// another local branch (remote ".") or a remote that isn't there
+// (anymore), neither has a remote-tracking ref.
+//
+//	fedora/f29 -> refs/remotes/fedora/f29
+func getTrackingRef(repo repository, branch string) (string, error) {
+	remote, merge, err := repo.Upstream(branch)
 	if err != nil {
-		return fmt.Errorf("Failed to set config remote: %v", err)
+		return "", err
 	}
-	err = cfg.SetString(fmt.Sprintf("branch.%s.merge", branch), fmt.Sprintf("refs/heads/%s", short_branch))
-	if err != nil {
-		return fmt.Errorf("Failed to set config merge: %v", err)
+	if remote == "" || remote == "." {
+		return "", nil
+	}
+	_, err = repo.RemoteURL(remote)
+	if errors.Is(err, errNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("unable to lookup remote '%s': %v", remote, err)
 	}
 
-	return nil
+	return fmt.Sprintf("refs/remotes/%s/%s", remote, strings.TrimPrefix(merge, "refs/heads/")), nil
 }
 
-// Setup a local branch corresponding to each remote branch.
-//
-//  git branch -a
-//  ...
-//  fedora/31 -> remotes/fedora/f31
-//
-// This makes sure all the local branches exist and are up to date.
-func SetupRpmBranches(repo *git.Repository) error {
+// Get the local branches whose remote-tracking branch no longer
+// exists, usually because it was pruned by the fetch.
+func getDeadLocalBranches(repo repository) ([]string, error) {
 
-	branches, err := getExpectedLocalBranches(repo)
+	var branches []string
+	local_branches, err := repo.Branches(localBranch)
 	if err != nil {
-		return fmt.Errorf("unable to get branches: %v", err)
+		return nil, err
 	}
+	for _, branch := range local_branches { // fedora/f29
 
-	for _, branch := range branches {
-		err = setupRpmBranch(repo, branch)
+		tracking_ref, err := getTrackingRef(repo, branch)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if tracking_ref == "" {
+			continue
 		}
+
+		_, err = repo.RefTarget(tracking_ref)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("unable to lookup '%s': %v", tracking_ref, err)
+		}
+		branches = append(branches, branch)
 	}
 
-	return nil
+	return branches, nil
 }
 
-// Walk all the local branches and perform a git pull.
-func PullAll(repo *git.Repository) error {
-
-	err := FetchAll(repo)
+func pruneRpmBranch(repo repository, branch string, policy PrunePolicy, run *mirrorRun) error {
+	target, err := repo.BranchTarget(branch, localBranch)
 	if err != nil {
-		return fmt.Errorf("Unable to fetch for pull: %v", err)
+		return fmt.Errorf("unable to lookup branch '%s': %v", branch, err)
 	}
 
-	branches, err := getExpectedLocalBranches(repo)
+	is_head, err := repo.IsHead(branch)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to check if '%s' is HEAD: %v", branch, err)
+	}
+	if is_head {
+		run.logger().Info("not pruning branch, it is checked out", "branch", branch)
+		return nil
 	}
 
-	for _, branch := range branches {
+	br := run.branch(branch)
+	br.OldOid = target
 
-		err = repo.SetHead("refs/heads/" + branch)
+	if policy == PruneArchive {
+		archive := "refs/archive/" + branch
+		err = repo.CreateRef(archive, target, true, "prune: archive "+branch)
 		if err != nil {
-			return fmt.Errorf("unable to set head to '%s': %v", branch, err)
+			return fmt.Errorf("unable to archive '%s' to '%s': %v", branch, archive, err)
 		}
+	}
 
-		err = repo.CheckoutHead(&git.CheckoutOpts{
-			Strategy: git.CheckoutForce,
-		})
-		if err != nil {
-			return fmt.Errorf("unable to checkout head: %v", err)
-		}
+	// this also removes the branch.<branch>.* tracking config
+	err = repo.DeleteBranch(branch)
+	if err != nil {
+		return fmt.Errorf("unable to delete branch '%s': %v", branch, err)
+	}
 
-		local_branch, err := repo.LookupBranch(branch, git.BranchLocal)
-		if err != nil {
-			return fmt.Errorf("unable to lookup branch '%s': %v", branch, err)
-		}
-		defer local_branch.Free()
+	br.Status = BranchPruned
+	if policy == PruneArchive {
+		br.Status = BranchArchived
+	}
+	run.branchUpdate(br)
 
-		remote_branch, err := repo.LookupBranch(branch, git.BranchRemote)
-		if err != nil {
-			return fmt.Errorf("unable to lookup remote branch '%s': %v", branch, err)
-		}
-		defer remote_branch.Free()
+	return nil
+}
 
-		commit, err := repo.AnnotatedCommitFromRef(remote_branch.Reference)
-		if err != nil {
-			return fmt.Errorf("unable to lookup commit for branch '%v': %v", branch, err)
-		}
-		defer commit.Free()
+func pruneRpmBranches(repo repository, policy PrunePolicy, run *mirrorRun) error {
+	switch policy {
+	case PruneNone:
+		return nil
+	case PruneDelete, PruneArchive:
+	default:
+		return fmt.Errorf("unknown prune policy '%s'", policy)
+	}
 
-		commits := make([]*git.AnnotatedCommit, 1)
-		commits[0] = commit
+	branches, err := getDeadLocalBranches(repo)
+	if err != nil {
+		return fmt.Errorf("unable to get branches: %v", err)
+	}
 
-		analysis, _, err := repo.MergeAnalysis(commits)
+	for _, branch := range branches {
+		err = pruneRpmBranch(repo, branch, policy, run)
 		if err != nil {
-			return fmt.Errorf("unable to run merge analysis: %v", err)
+			return err
 		}
+	}
 
-		if (analysis & git.MergeAnalysisUpToDate) != 0 {
-			// OK
-		} else if (analysis & git.MergeAnalysisFastForward) != 0 {
-			local_branch_ref := local_branch.Reference
-			_, err := local_branch_ref.SetTarget(remote_branch.Reference.Target(), "pull: Fast-forward")
-			if err != nil {
-				return fmt.Errorf("Fast-forward merge of '%s' failed: %v", branch, err)
-			}
+	return nil
+}
 
-			err = repo.CheckoutHead(&git.CheckoutOpts{
-				Strategy: git.CheckoutForce,
-			})
-			if err != nil {
-				return fmt.Errorf("unable to checkout head: %v", err)
-			}
-		} else if (analysis & git.MergeAnalysisNormal) != 0 {
-			return fmt.Errorf("A merge is required for '%s'", branch)
-		} else {
-			return fmt.Errorf("Unhandled MergeAnalysis? '%v'", analysis)
+func setupRpmBranches(repo repository, rcs []RemoteConfig, run *mirrorRun) error {
+
+	branches, err := getExpectedLocalBranches(repo, rcs)
+	if err != nil {
+		return fmt.Errorf("unable to get branches: %v", err)
+	}
+
+	for _, bm := range branches {
+		err = setupRpmBranch(repo, bm, run)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// Does all the steps to mirror an RPM: clone, setup branches,
-// fetch, pull, etc.  Will get the existing repo, in whatever
-// state it may be in, in to an updated state.
-func RpmMirror(config string, rpm string, path string) error {
-	cfg_tmpl, err := LoadConfig(config)
+// What to do when a branch can't be fast-forwarded because the
+// upstream branch was rewritten (e.g. force pushed).
+type DivergedPolicy string
+
+const (
+	DivergedSkip  DivergedPolicy = "skip"  // leave the branch alone and report it
+	DivergedReset DivergedPolicy = "reset" // back up the branch and reset it to the remote
+)
+
+// Save the current tip of a branch under a backup ref before it
+// gets reset and return the name of the backup ref.  The time is down
+// to the nanosecond so that two resets in the same second (e.g. runs
+// back to back) don't collide.
+//
+//	refs/rgm/backup/fedora/f31/20201020T223005.123456789Z
+func backupBranch(repo repository, branch string, target string) (string, error) {
+	backup := fmt.Sprintf("refs/rgm/backup/%s/%s", branch, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	err := repo.CreateRef(backup, target, false, "pull: backup of "+branch)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("unable to backup '%s' to '%s': %v", branch, backup, err)
 	}
 
-	cfg, err := ExecConfigTemplate(cfg_tmpl, rpm)
+	return backup, nil
+}
+
+// Bring a local branch up to date with its remote branch by updating
+// the ref directly.  Nothing is checked out unless it is the current
+// branch, and then never at the cost of local edits.
+func pullBranch(repo repository, bm branchMapping, policy DivergedPolicy, run *mirrorRun) error {
+	branch := bm.local
+
+	local_oid, err := repo.BranchTarget(branch, localBranch)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to lookup branch '%s': %v", branch, err)
 	}
 
-	repo, err := git.Clone(cfg.Origin.URL, path, &git.CloneOptions{Bare: false})
+	conflict, err := upstreamConflict(repo, bm)
 	if err != nil {
 		return err
 	}
+	if conflict != "" {
+		// already reported if the branches were just set up
+		if run.branch(branch).Status != BranchConflict {
+			reportConflict(run, bm, conflict)
+		}
+		return nil
+	}
 
-	err = SetupRpmRemotes(repo, cfg.Remotes)
+	remote_oid, err := repo.BranchTarget(bm.tracking(), remoteBranch)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to lookup remote branch '%s': %v", bm.tracking(), err)
+	}
+
+	br := run.branch(branch)
+	if br.Status != BranchCreated {
+		br.Status = BranchUpToDate
+		br.OldOid = local_oid
+		br.NewOid = local_oid
 	}
 
-	err = FetchAll(repo)
+	if local_oid == remote_oid {
+		return nil // OK
+	}
+
+	// the remote is already part of the local branch
+	ahead, err := repo.DescendantOf(local_oid, remote_oid)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to compare '%s' with its remote: %v", branch, err)
+	}
+	if ahead {
+		return nil // OK
 	}
 
-	err = SetupRpmBranches(repo)
+	fast_forward, err := repo.DescendantOf(remote_oid, local_oid)
+	if err != nil {
+		return fmt.Errorf("unable to compare '%s' with its remote: %v", branch, err)
+	}
+
+	msg := "pull: Fast-forward"
+	status := BranchFastForwarded
+	if !fast_forward {
+		if policy != DivergedReset {
+			// not a failure, it is only reported
+			run.logger().Warn("branch was rewritten upstream, skipped", "branch", branch)
+			br.Status = BranchDiverged
+			run.branchUpdate(br)
+			return nil
+		}
+
+		backup, err := backupBranch(repo, branch, local_oid)
+		if err != nil {
+			return err
+		}
+		run.logger().Info("branch was rewritten upstream, reset it", "branch", branch, "backup", backup)
+		msg = "pull: Reset to rewritten upstream"
+		status = BranchReset
+		br.Backup = backup
+	}
+
+	err = repo.UpdateBranch(branch, remote_oid, msg)
 	if err != nil {
 		return err
 	}
+	br.Status = status
+	br.NewOid = remote_oid
+	run.branchUpdate(br)
+
+	return nil
+}
 
-	err = PullAll(repo)
+// The pull part of PullAll, without the fetch, for the branches that
+// pass the filters in rcs.
+func pullBranches(ctx context.Context, repo repository, rcs []RemoteConfig, policy DivergedPolicy, run *mirrorRun) error {
+
+	switch policy {
+	case "", DivergedSkip, DivergedReset:
+	default:
+		return fmt.Errorf("unknown diverged policy '%s'", policy)
+	}
+
+	branches, err := getExpectedLocalBranches(repo, rcs)
 	if err != nil {
 		return err
 	}
 
+	var failed []string
+	for _, bm := range branches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err = pullBranch(repo, bm, policy, run)
+		if err != nil {
+			run.logger().Warn("unable to pull branch", "branch", bm.local, "err", err)
+			failed = append(failed, err.Error())
+
+			br := run.branch(bm.local)
+			br.Status = BranchFailed
+			br.Error = err.Error()
+			run.branchUpdate(br)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to pull %d branch(es): %s", len(failed), strings.Join(failed, "; "))
+	}
+
 	return nil
 }
+
+// Clone a repo, giving up after the timeout of the origin (if any)
+// and retrying transient failures.
+func cloneRpm(ctx context.Context, be backend, origin *RemoteConfig, url string, path string, bare bool, run *mirrorRun) error {
+	clone := func() error {
+		return runContext(ctx, time.Duration(origin.Timeout), func(ctx context.Context) error {
+			return be.Clone(ctx, url, path, bare, newFetchOptions(origin, run))
+		})
+	}
+
+	return withRetry(ctx, run.logger(), origin.retryConfig(), fmt.Sprintf("git clone of '%s'", url), clone)
+}
+
+// Open the repo at path if it already exists, otherwise clone it
+// from the first of the origin URLs that works.
+func openOrCloneRpm(ctx context.Context, be backend, origin *RemoteConfig, path string, bare bool, run *mirrorRun) (repository, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		repo, err := be.Open(path)
+		if err == nil {
+			return repo, nil
+		}
+		// Not a repo (e.g. an empty directory), let clone decide
+		// if it can be used.
+	}
+
+	urls := origin.CandidateURLs()
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no URL for origin '%v'", origin.Name)
+	}
+
+	for _, url := range urls {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		err := cloneRpm(ctx, be, origin, url, path, bare, run)
+		if err == nil {
+			origin.URL = url
+			if run != nil {
+				run.report.Cloned = true
+			}
+			return be.Open(path)
+		}
+		if errors.Is(err, errAbandoned) {
+			// it may still be cloning in to path
+			return nil, fmt.Errorf("git clone of '%s' to '%s' failed: %w", url, path, err)
+		}
+		if len(urls) == 1 {
+			return nil, fmt.Errorf("git clone of '%s' to '%s' failed: %w", url, path, err)
+		}
+		run.logger().Warn("git clone failed", "url", url, "path", path, "err", err)
+	}
+
+	return nil, fmt.Errorf("unable to clone '%s' from any of the origin URLs", path)
+}
+
+// Does all the steps to mirror an RPM: clone, setup branches,
+// fetch, pull, etc.  Will get the existing repo, in whatever
+// state it may be in, in to an updated state.
+//
+// Running it again on an existing mirror reconciles the remotes
+// with the config (adds missing ones, fixes changed URLs),
+// fetches, creates any new branches and fast-forwards the rest.
+//
+// With Bare set in the config a new mirror is cloned without a
+// worktree.  Either way the branches are updated without checking
+// them out.
+//
+// Without a config file the default ones are used, see ConfigFiles.
+//
+// The Report says what was done to each remote and branch.  It is
+// returned even when there is an error, covering the steps that
+// were done up to that point.
+//
+// See Mirror to run the steps one at a time.
+func RpmMirror(config string, rpm string, path string) (*Report, error) {
+	return RpmMirrorContext(context.Background(), config, rpm, path)
+}
+
+// Same as RpmMirror but gives up when the context is done.  Each
+// remote is also limited by its own Timeout, if it has one.
+func RpmMirrorContext(ctx context.Context, config string, rpm string, path string) (*Report, error) {
+	var cfg_tmpl Config
+	var err error
+	if config == "" {
+		cfg_tmpl, _, err = LoadDefaultConfig()
+	} else {
+		cfg_tmpl, err = LoadConfig(config)
+	}
+	if err != nil {
+		report := &Report{Rpm: rpm, Path: path, Start: time.Now(), Error: err.Error()}
+		return report, err
+	}
+
+	return RpmMirrorConfigContext(ctx, cfg_tmpl, rpm, path)
+}
+
+// Same as RpmMirror but with a config (template) that was already
+// loaded, so it can be reused for many RPMs.
+func RpmMirrorConfig(cfg_tmpl Config, rpm string, path string) (*Report, error) {
+	return RpmMirrorConfigContext(context.Background(), cfg_tmpl, rpm, path)
+}
+
+// Same as RpmMirrorConfig but gives up when the context is done.
+func RpmMirrorConfigContext(ctx context.Context, cfg_tmpl Config, rpm string, path string) (*Report, error) {
+	return RpmMirrorOptions(ctx, cfg_tmpl, rpm, path, Options{})
+}
+
+// Same as RpmMirrorConfigContext but logs to the Logger of the
+// options and tells their callbacks about the progress.
+func RpmMirrorOptions(ctx context.Context, cfg_tmpl Config, rpm string, path string, opts Options) (*Report, error) {
+	m, err := NewMirror(cfg_tmpl, rpm, path, opts)
+	if err != nil {
+		report := &Report{Rpm: rpm, Path: path, Start: time.Now(), Error: err.Error()}
+		return report, err
+	}
+	defer m.Close()
+
+	return m.Run(ctx)
+}
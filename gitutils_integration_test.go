@@ -1,8 +1,9 @@
-// +build integration
+//go:build integration && !nolibgit2
+// +build integration,!nolibgit2
 
 // Perform integration tests by pulling from actual RPM repos.
 //
-//   go test -tags=integration
+//	go test -tags=integration
 //
 // **NOTE** These tests are very slow so don't waste your
 // time running them until after the local tests have passed.
@@ -0,0 +1,124 @@
+//go:build !nolibgit2
+
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/libgit2/git2go"
+)
+
+// The steps of RpmMirror on a libgit2 repo of the caller, only built
+// along with the libgit2 backend.
+
+// For an existing Git repo and an RPM (e.g. cowsay) Setup the remotes.
+//
+// This is a best effort procedure.  Not all remotes will be available
+// (fedora might not have package x).  As long as at least one remote
+// works it is a success.
+//
+// When a remote has several candidate URLs the first one that answers
+// is used and recorded in the URL of its RemoteConfig.  The tags of
+// the "origin" remote of a clone are fetched in to refs/tags/origin/
+// like those of the other remotes.
+func SetupRpmRemotes(repo *git.Repository, rcs []RemoteConfig) error {
+	return SetupRpmRemotesContext(context.Background(), repo, rcs)
+}
+
+// Same as SetupRpmRemotes but gives up when the context is done.
+// Checking the URLs of a remote is also limited by its Timeout.
+func SetupRpmRemotesContext(ctx context.Context, repo *git.Repository, rcs []RemoteConfig) error {
+	r := newLibgit2Repo(repo)
+	err := setupRpmRemotes(ctx, r, rcs, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.RemoteURL("origin")
+	if errors.Is(err, errNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return setupRemoteTags(r, "origin")
+}
+
+// Fetch all the remotes of the repo.
+//
+// As long as at least one remote can be fetched it is a success.
+func FetchAll(repo *git.Repository) error {
+	return FetchAllContext(context.Background(), repo, nil)
+}
+
+// Same as FetchAll but gives up when the context is done.
+//
+// A remote that has a Timeout in rcs is stopped (and logged) once
+// the timeout has passed, while the other remotes still get fetched.
+// If the fetch doesn't stop, it may still be writing to the repo and
+// FetchAllContext fails without fetching the rest.
+// Transient failures are retried according to the Retry in rcs.
+func FetchAllContext(ctx context.Context, repo *git.Repository, rcs []RemoteConfig) error {
+	return fetchAll(ctx, newLibgit2Repo(repo), rcs, nil)
+}
+
+// Remove the local branches whose upstream branch was deleted.
+//
+// With PruneArchive the branch is kept under refs/archive/ first.
+//
+//	git branch -a
+//	fedora/f29 -> (gone)
+//
+//	git show-ref
+//	... refs/archive/fedora/f29
+//
+// The remote-tracking refs themselves are pruned by FetchAll once
+// pruning has been turned on (see RpmMirror).
+func PruneRpmBranches(repo *git.Repository, policy PrunePolicy) error {
+	return pruneRpmBranches(newLibgit2Repo(repo), policy, nil)
+}
+
+// Setup a local branch corresponding to each remote branch.
+//
+//	git branch -a
+//	...
+//	fedora/31 -> remotes/fedora/f31
+//
+// This makes sure all the local branches exist and are up to date.
+func SetupRpmBranches(repo *git.Repository) error {
+	return SetupRpmBranchesConfig(repo, nil)
+}
+
+// Same as SetupRpmBranches but only for the branches that pass the
+// IncludeBranches and ExcludeBranches of their remote in rcs.
+func SetupRpmBranchesConfig(repo *git.Repository, rcs []RemoteConfig) error {
+	return setupRpmBranches(newLibgit2Repo(repo), rcs, nil)
+}
+
+// Walk all the local branches and perform a git pull.
+//
+// Branches that can't be fast-forwarded are skipped and reported.
+func PullAll(repo *git.Repository) error {
+	return PullAllWithPolicy(repo, DivergedSkip)
+}
+
+// Walk all the local branches and perform a git pull, handling
+// branches that were rewritten upstream according to the policy.
+//
+// A branch that fails doesn't stop the others from being pulled,
+// the failures are all reported together at the end.
+func PullAllWithPolicy(repo *git.Repository, policy DivergedPolicy) error {
+	return PullAllContext(context.Background(), repo, policy)
+}
+
+// Same as PullAllWithPolicy but gives up when the context is done.
+func PullAllContext(ctx context.Context, repo *git.Repository, policy DivergedPolicy) error {
+
+	err := FetchAllContext(ctx, repo, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch for pull: %v", err)
+	}
+
+	return pullBranches(ctx, newLibgit2Repo(repo), nil, policy, nil)
+}
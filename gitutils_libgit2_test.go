@@ -0,0 +1,220 @@
+//go:build !nolibgit2
+
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRpmMirrorParts(t *testing.T) {
+	onlyLibgit2(t)
+
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	//fmt.Println(dir)
+	// Need to debug tests?  Comment out Remove and Print the Git repo dir.
+
+	cfg_tmpl, err := rgm.LoadConfig("testdata/config.json")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	rpm := "patch"
+	cfg, err := rgm.ExecConfigTemplate(cfg_tmpl, rpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.Clone(cfg.Origin.URL, dir, &git.CloneOptions{Bare: false})
+	if err != nil {
+		t.Fatalf("git clone of '%s' to '%s' failed: %v", cfg.Origin.URL, dir, err)
+	}
+
+	// trying to clone a second time should fail because it already exists
+	_, err = git.Clone(cfg.Origin.URL, dir, &git.CloneOptions{Bare: false})
+	if err == nil {
+		t.Fatalf("git (2nd) clone of '%s' to '%s' should've failed", cfg.Origin.URL, dir)
+	} else {
+		if !strings.Contains(err.Error(), "exists and is not an empty directory") {
+			t.Fatalf("git (2nd) clone of '%s' to '%s' failed: %v", cfg.Origin.URL, dir, err)
+		}
+	}
+
+	t.Run("SetupRpmRemotes", func(t *testing.T) {
+		err = rgm.SetupRpmRemotes(repo, cfg.Remotes)
+		if err != nil {
+			t.Fatalf("setup remotes failed: %v", err)
+		}
+
+		out_bytes, err := exec.Command("git", "-C", dir, "remote").Output()
+		if err != nil {
+			t.Fatalf("unable to get remote: %v", err)
+		}
+		out := string(out_bytes)
+
+		for _, c := range cfg.Remotes {
+			remote := c.Name
+			if !strings.Contains(out, remote) {
+				t.Errorf("remote '%s' not found", remote)
+			}
+		}
+	})
+
+	t.Run("FetchAll", func(t *testing.T) {
+		err = rgm.FetchAll(repo)
+		if err != nil {
+			t.Fatalf("FetchAll failed: %v", err)
+		}
+
+		cases := []BranchCase{
+			{"remotes/fedora/f29", true},
+			{"remotes/fedora/f31", true},
+			{"remotes/fedora/f2", false},
+			{"remotes/fedora/f3", false},
+			{"remotes/centos/c6", true},
+			{"remotes/centos/c7", true},
+			{"remotes/other/my/branch/with/lots/of/parts", true},
+		}
+		testBranches(t, dir, cases)
+
+		tag_cases := []TagCase{
+			{"fedora/patch-2.7.6-12.fc31", true},
+			{"fedora/release", true},
+			{"centos/imports/c7/patch-2.7.1-12.el7", true},
+			{"centos/release", true},
+			{"release", false},
+			{"patch-2.7.6-12.fc31", false},
+		}
+		testTags(t, dir, tag_cases)
+	})
+
+	t.Run("SetupRpmBranches", func(t *testing.T) {
+		err = rgm.SetupRpmBranches(repo)
+		if err != nil {
+			t.Fatalf("SetupRpmBranches failed: %v", err)
+		}
+
+		cases := []BranchCase{
+			{"fedora/f29", true},
+			{"fedora/f31", true},
+			{"tes/fedora/f31", false},
+			{"fedora/f2", false},
+			{"fedora/f3", false},
+			{"centos/c6", true},
+			{"centos/c7", true},
+			{"other/my/branch/with/lots/of/parts", true},
+		}
+		testBranches(t, dir, cases)
+
+		testTrackingBranch(t, dir, "fedora/f31", "remotes/fedora/f31")
+	})
+
+	t.Run("PullAll", func(t *testing.T) {
+
+		// before, all up to date
+		cases := []BranchStatusCase{
+			{"fedora/f29", true},
+			{"fedora/f30", true},
+			{"fedora/f31", true},
+			{"centos/c6", true},
+			{"centos/c7", true},
+			{"other/my/branch/with/lots/of/parts", true},
+		}
+		testBranchStatus(t, dir, cases)
+
+		branches := []string{
+			"fedora/f29",
+			"fedora/f31",
+			"centos/c7",
+			"other/my/branch/with/lots/of/parts",
+		}
+		resetBranches(t, dir, branches)
+
+		// now some are out of date
+		cases = []BranchStatusCase{
+			{"fedora/f29", false},
+			{"fedora/f30", true},
+			{"fedora/f31", false},
+			{"centos/c6", true},
+			{"centos/c7", false},
+			{"other/my/branch/with/lots/of/parts", false},
+		}
+		testBranchStatus(t, dir, cases)
+
+		err = rgm.PullAll(repo)
+		if err != nil {
+			t.Error(err)
+		}
+
+		// now all should be up to date
+		cases = []BranchStatusCase{
+			{"fedora/f29", true},
+			{"fedora/f30", true},
+			{"fedora/f31", true},
+			{"centos/c6", true},
+			{"centos/c7", true},
+			{"other/my/branch/with/lots/of/parts", true},
+		}
+		testBranchStatus(t, dir, cases)
+	})
+}
+
+// With several URLs the first that answers should be used.
+func TestSetupRpmRemotesFallback(t *testing.T) {
+	onlyLibgit2(t)
+
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg_tmpl, err := rgm.LoadConfig("testdata/config_urls.json")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	cfg, err := rgm.ExecConfigTemplate(cfg_tmpl, "patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.InitRepository(dir, false)
+	if err != nil {
+		t.Fatalf("git init of '%s' failed: %v", dir, err)
+	}
+	defer repo.Free()
+
+	err = rgm.SetupRpmRemotes(repo, cfg.Remotes)
+	if err != nil {
+		t.Fatalf("setup remotes failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"fedora": "testdata/patch.fedora",
+		"centos": "testdata/patch.centos",
+	}
+	for _, rc := range cfg.Remotes {
+		if rc.URL != expected[rc.Name] {
+			t.Errorf("remote '%s' recorded URL '%s', expected '%s'", rc.Name, rc.URL, expected[rc.Name])
+		}
+
+		out_bytes, err := exec.Command("git", "-C", dir, "remote", "get-url", rc.Name).Output()
+		if err != nil {
+			t.Fatalf("unable to get-url for '%s': %v", rc.Name, err)
+		}
+		url := strings.TrimSpace(string(out_bytes))
+		if url != expected[rc.Name] {
+			t.Errorf("remote '%s' has URL '%s', expected '%s'", rc.Name, url, expected[rc.Name])
+		}
+	}
+}
@@ -1,170 +1,31 @@
 package rgm_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jmahler/rgm"
-	"github.com/libgit2/git2go"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestRpmMirrorParts(t *testing.T) {
-
-	dir, err := ioutil.TempDir("", "rgm")
-	if err != nil {
-		t.Fatalf("failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(dir)
-	//fmt.Println(dir)
-	// Need to debug tests?  Comment out Remove and Print the Git repo dir.
-
-	cfg_tmpl, err := rgm.LoadConfig("testdata/config.json")
-	if err != nil {
-		t.Fatalf("failed to load config: %v", err)
-	}
-
-	rpm := "patch"
-	cfg, err := rgm.ExecConfigTemplate(cfg_tmpl, rpm)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	repo, err := git.Clone(cfg.Origin.URL, dir, &git.CloneOptions{Bare: false})
-	if err != nil {
-		t.Fatalf("git clone of '%s' to '%s' failed: %v", cfg.Origin.URL, dir, err)
-	}
-
-	// trying to clone a second time should fail because it already exists
-	_, err = git.Clone(cfg.Origin.URL, dir, &git.CloneOptions{Bare: false})
-	if err == nil {
-		t.Fatalf("git (2nd) clone of '%s' to '%s' should've failed", cfg.Origin.URL, dir)
-	} else {
-		if !strings.Contains(err.Error(), "exists and is not an empty directory") {
-			t.Fatalf("git (2nd) clone of '%s' to '%s' failed: %v", cfg.Origin.URL, dir, err)
-		}
-	}
-
-	t.Run("SetupRpmRemotes", func(t *testing.T) {
-		err = rgm.SetupRpmRemotes(repo, cfg.Remotes)
-		if err != nil {
-			t.Fatalf("setup remotes failed: %v", err)
-		}
-
-		out_bytes, err := exec.Command("git", "-C", dir, "remote").Output()
-		if err != nil {
-			t.Fatalf("unable to get remote: %v", err)
-		}
-		out := string(out_bytes)
-
-		for _, c := range cfg.Remotes {
-			remote := c.Name
-			if !strings.Contains(out, remote) {
-				t.Errorf("remote '%s' not found", remote)
-			}
-		}
-	})
-
-	t.Run("FetchAll", func(t *testing.T) {
-		err = rgm.FetchAll(repo)
-		if err != nil {
-			t.Fatalf("FetchAll failed: %v", err)
-		}
-
-		cases := []BranchCase{
-			{"remotes/fedora/f29", true},
-			{"remotes/fedora/f31", true},
-			{"remotes/fedora/f2", false},
-			{"remotes/fedora/f3", false},
-			{"remotes/centos/c6", true},
-			{"remotes/centos/c7", true},
-			{"remotes/other/my/branch/with/lots/of/parts", true},
-		}
-		testBranches(t, dir, cases)
-	})
-
-	t.Run("SetupRpmBranches", func(t *testing.T) {
-		err = rgm.SetupRpmBranches(repo)
-		if err != nil {
-			t.Fatalf("SetupRpmBranches failed: %v", err)
-		}
-
-		cases := []BranchCase{
-			{"fedora/f29", true},
-			{"fedora/f31", true},
-			{"tes/fedora/f31", false},
-			{"fedora/f2", false},
-			{"fedora/f3", false},
-			{"centos/c6", true},
-			{"centos/c7", true},
-			{"other/my/branch/with/lots/of/parts", true},
-		}
-		testBranches(t, dir, cases)
-
-		testTrackingBranch(t, dir, "fedora/f31", "remotes/fedora/f31")
-	})
-
-	t.Run("PullAll", func(t *testing.T) {
-
-		// before, all up to date
-		cases := []BranchStatusCase{
-			{"fedora/f29", true},
-			{"fedora/f30", true},
-			{"fedora/f31", true},
-			{"centos/c6", true},
-			{"centos/c7", true},
-			{"other/my/branch/with/lots/of/parts", true},
-		}
-		testBranchStatus(t, dir, cases)
-
-		branches := []string{
-			"fedora/f29",
-			"fedora/f31",
-			"centos/c7",
-			"other/my/branch/with/lots/of/parts",
-		}
-		resetBranches(t, dir, branches)
-
-		// now some are out of date
-		cases = []BranchStatusCase{
-			{"fedora/f29", false},
-			{"fedora/f30", true},
-			{"fedora/f31", false},
-			{"centos/c6", true},
-			{"centos/c7", false},
-			{"other/my/branch/with/lots/of/parts", false},
-		}
-		testBranchStatus(t, dir, cases)
-
-		err = rgm.PullAll(repo)
-		if err != nil {
-			t.Error(err)
-		}
-
-		// now all should be up to date
-		cases = []BranchStatusCase{
-			{"fedora/f29", true},
-			{"fedora/f30", true},
-			{"fedora/f31", true},
-			{"centos/c6", true},
-			{"centos/c7", true},
-			{"other/my/branch/with/lots/of/parts", true},
-		}
-		testBranchStatus(t, dir, cases)
-	})
-}
-
 // Split branch output in to lines and trim whitespace.
 //
-//    git branch -a
-//      origin/f29
-//    * origin/f30
-//      remotes/fedora/f29
-//
-//    ["origin/f29", "origin/f30", "remotes/fedora/f29"]
+//	git branch -a
+//	  origin/f29
+//	* origin/f30
+//	  remotes/fedora/f29
 //
+//	["origin/f29", "origin/f30", "remotes/fedora/f29"]
 func splitBranchOutput(in string) []string {
 	lines := strings.Split(in, "\n")
 	branches := make([]string, len(lines))
@@ -224,6 +85,38 @@ func testBranches(t *testing.T, dir string, cases []BranchCase) {
 	}
 }
 
+type TagCase struct {
+	Tag    string
+	Exists bool
+}
+
+func testTags(t *testing.T, dir string, cases []TagCase) {
+	t.Helper()
+
+	out_byte, err := exec.Command("git", "-C", dir, "tag").Output()
+	if err != nil {
+		t.Fatalf("unable to run git tag on '%s': %v", dir, err)
+	}
+	tags := strings.Split(string(out_byte), "\n")
+
+	for _, tc := range cases {
+		t.Run(tc.Tag, func(t *testing.T) {
+			found := false
+			for _, tag := range tags {
+				if tc.Tag == tag {
+					found = true
+					break
+				}
+			}
+			if !found && tc.Exists {
+				t.Errorf("didn't find tag '%s'", tc.Tag)
+			} else if found && !tc.Exists {
+				t.Errorf("found unexpected tag '%s'", tc.Tag)
+			}
+		})
+	}
+}
+
 // Reset branches back to older versions.
 func resetBranches(t *testing.T, dir string, branches []string) {
 	t.Helper()
@@ -280,9 +173,738 @@ func TestRpmMirror(t *testing.T) {
 
 	config := "testdata/config.json"
 	rpm := "patch"
-	err = rgm.RpmMirror(config, rpm, path)
+	_, err = rgm.RpmMirror(config, rpm, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Running RpmMirror on an existing mirror should bring it up to date
+// rather than failing on the clone.
+func TestRpmMirrorUpdate(t *testing.T) {
+	path, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	config := "testdata/config.json"
+	rpm := "patch"
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break a remote and put some branches out of date
+	_, err = exec.Command("git", "-C", path, "remote", "set-url", "fedora", "testdata/moved.fedora").Output()
+	if err != nil {
+		t.Fatalf("unable to set-url for fedora: %v", err)
+	}
+	resetBranches(t, path, []string{"fedora/f31", "centos/c7"})
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatalf("2nd RpmMirror failed: %v", err)
+	}
+
+	out_bytes, err := exec.Command("git", "-C", path, "remote", "get-url", "fedora").Output()
+	if err != nil {
+		t.Fatalf("unable to get-url for fedora: %v", err)
+	}
+	url := strings.TrimSpace(string(out_bytes))
+	if url != "testdata/patch.fedora" {
+		t.Errorf("fedora url wasn't updated, got '%s'", url)
+	}
+
+	cases := []BranchStatusCase{
+		{"fedora/f31", true},
+		{"centos/c7", true},
+	}
+	testBranchStatus(t, path, cases)
+}
+
+// The origin should be cloned from the first URL that works.
+func TestRpmMirrorFallback(t *testing.T) {
+	path, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	_, err = rgm.RpmMirror("testdata/config_urls.json", "patch", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []BranchCase{
+		{"fedora/f31", true},
+		{"centos/c7", true},
+	}
+	testBranches(t, path, cases)
+}
+
+// Copy the testdata repos for an rpm so they can be modified and
+// write a config for them.  Returns the path to the config.
+func setupUpstream(t *testing.T, dir string, rpm string, cfg rgm.Config) string {
+	t.Helper()
+
+	for _, rc := range append([]rgm.RemoteConfig{cfg.Origin}, cfg.Remotes...) {
+		src := fmt.Sprintf("testdata/%s.%s", rpm, rc.Name)
+		_, err := exec.Command("cp", "-r", src, dir).Output()
+		if err != nil {
+			t.Fatalf("unable to copy '%s' to '%s': %v", src, dir, err)
+		}
+	}
+
+	cfg.Origin.URL = filepath.Join(dir, "{{.RPM}}."+cfg.Origin.Name)
+	for i := range cfg.Remotes {
+		cfg.Remotes[i].URL = filepath.Join(dir, "{{.RPM}}."+cfg.Remotes[i].Name)
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("unable to marshal config: %v", err)
+	}
+	config := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(config, data, 0644)
+	if err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+
+	return config
+}
+
+func testRefExists(t *testing.T, dir string, ref string, exists bool) {
+	t.Helper()
+
+	err := exec.Command("git", "-C", dir, "show-ref", "--verify", "--quiet", ref).Run()
+	if err == nil && !exists {
+		t.Errorf("found unexpected ref '%s'", ref)
+	} else if err != nil && exists {
+		t.Errorf("didn't find ref '%s'", ref)
+	}
+}
+
+func TestRpmMirrorPrune(t *testing.T) {
+	cases := []struct {
+		Policy   rgm.PrunePolicy
+		Branch   bool // local branch still exists
+		Archived bool // branch was kept in refs/archive/
+	}{
+		{rgm.PruneNone, true, false},
+		{rgm.PruneDelete, false, false},
+		{rgm.PruneArchive, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.Policy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rgm")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			rpm := "patch"
+			config := setupUpstream(t, dir, rpm, rgm.Config{
+				Origin:  rgm.RemoteConfig{Name: "origin"},
+				Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+				Prune:   c.Policy,
+			})
+			path := filepath.Join(dir, "mirror")
+
+			_, err = rgm.RpmMirror(config, rpm, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testRefExists(t, path, "refs/heads/fedora/f29", true)
+
+			// branches of the user that track a local branch or a
+			// remote that isn't there have nothing to be pruned for
+			for _, args := range [][]string{
+				{"branch", "mine", "refs/heads/fedora/f31"},
+				{"config", "branch.mine.remote", "."},
+				{"config", "branch.mine.merge", "refs/heads/fedora/f31"},
+				{"branch", "old", "refs/heads/fedora/f31"},
+				{"config", "branch.old.remote", "gone"},
+				{"config", "branch.old.merge", "refs/heads/old"},
+			} {
+				_, err = exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+				if err != nil {
+					t.Fatalf("unable to git %v: %v", args, err)
+				}
+			}
+
+			// fedora retires f29
+			upstream := filepath.Join(dir, rpm+".fedora")
+			_, err = exec.Command("git", "-C", upstream, "branch", "-D", "f29").Output()
+			if err != nil {
+				t.Fatalf("unable to delete upstream branch: %v", err)
+			}
+
+			_, err = rgm.RpmMirror(config, rpm, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the remote-tracking ref is only pruned when pruning is on
+			testRefExists(t, path, "refs/remotes/fedora/f29", c.Policy == rgm.PruneNone)
+			testRefExists(t, path, "refs/heads/fedora/f29", c.Branch)
+			testRefExists(t, path, "refs/archive/fedora/f29", c.Archived)
+			testRefExists(t, path, "refs/heads/fedora/f31", true)
+			testRefExists(t, path, "refs/heads/mine", true)
+			testRefExists(t, path, "refs/heads/old", true)
+		})
+	}
+}
+
+func TestRpmMirrorBranchFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", IncludeBranches: []string{"f3*"}},
+			{Name: "centos", IncludeBranches: []string{"/^c[0-9]+$/"}, ExcludeBranches: []string{"c6"}},
+		},
+		Prune: rgm.PruneDelete,
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the branches that are filtered out aren't even fetched
+	for ref, exists := range map[string]bool{
+		"refs/heads/fedora/f30":      true,
+		"refs/heads/fedora/f31":      true,
+		"refs/heads/fedora/f29":      false,
+		"refs/remotes/fedora/f29":    false,
+		"refs/heads/centos/c7":       true,
+		"refs/heads/centos/c6":       false,
+		"refs/remotes/centos/c6":     false,
+		"refs/remotes/centos/master": false,
+		"refs/tags/centos/release":   true,
+	} {
+		testRefExists(t, path, ref, exists)
+	}
+
+	// fedora retires f30
+	upstream := filepath.Join(dir, rpm+".fedora")
+	_, err = exec.Command("git", "-C", upstream, "branch", "-D", "f30").Output()
+	if err != nil {
+		t.Fatalf("unable to delete upstream branch: %v", err)
+	}
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRefExists(t, path, "refs/remotes/fedora/f30", false)
+	testRefExists(t, path, "refs/heads/fedora/f30", false)
+	testRefExists(t, path, "refs/heads/fedora/f31", true)
+
+	// a filter that leaves nothing to fetch fetches nothing, the
+	// branches that are still upstream aren't pruned
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(config, bytes.Replace(data, []byte(`"f3*"`), []byte(`"f99"`), 1), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRefExists(t, path, "refs/remotes/fedora/f31", true)
+	testRefExists(t, path, "refs/remotes/fedora/master", false)
+	testRefExists(t, path, "refs/heads/centos/c7", true)
+}
+
+func TestRpmMirrorBranchName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", BranchName: `dist/{{.Remote}}/{{.Branch | trimPrefix "f"}}`},
+			{Name: "centos", BranchName: `el/{{.Branch | trimPrefix "c"}}`, IncludeBranches: []string{"c*"}},
+		},
+	})
+	path := filepath.Join(dir, "mirror")
 
+	_, err = rgm.RpmMirror(config, rpm, path)
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	for ref, exists := range map[string]bool{
+		"refs/heads/dist/fedora/31": true,
+		"refs/heads/dist/fedora/29": true,
+		"refs/heads/el/7":           true,
+		"refs/heads/el/6":           true,
+		"refs/heads/fedora/f31":     false,
+		"refs/heads/centos/c7":      false,
+		"refs/heads/origin/master":  true,
+	} {
+		testRefExists(t, path, ref, exists)
+	}
+
+	// the upstream comes from the mapping, not the name
+	testTrackingBranch(t, path, "dist/fedora/31", "fedora/f31")
+	testTrackingBranch(t, path, "el/7", "centos/c7")
+
+	upstream := filepath.Join(dir, rpm+".fedora")
+	commit := pushCommit(t, upstream, "f31", revParse(t, upstream, "f31"))
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revParse(t, path, "refs/heads/dist/fedora/31") != commit {
+		t.Errorf("expected dist/fedora/31 to be updated to %s", commit)
+	}
+
+	// two branches can't have the same local name
+	config = setupUpstream(t, t.TempDir(), rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora", BranchName: "fedora"}},
+	})
+	_, err = rgm.RpmMirror(config, rpm, filepath.Join(dir, "collision"))
+	if err == nil || !strings.Contains(err.Error(), "would be the local branch 'fedora'") {
+		t.Errorf("expected the same local name to fail: %v", err)
+	}
+}
+
+func revParse(t *testing.T, dir string, rev string) string {
+	t.Helper()
+
+	out_bytes, err := exec.Command("git", "-C", dir, "rev-parse", rev).Output()
+	if err != nil {
+		t.Fatalf("unable to rev-parse '%s' in '%s': %v", rev, dir, err)
+	}
+
+	return strings.TrimSpace(string(out_bytes))
+}
+
+// Add an empty commit on top of parent in a (bare) repo and point
+// the branch at it, like a push (or a force push) would.
+func pushCommit(t *testing.T, dir string, branch string, parent string) string {
+	t.Helper()
+
+	return pushTree(t, dir, branch, parent, parent+"^{tree}")
+}
+
+// Like pushCommit but the commit has the given tree, so that it
+// changes files.
+func pushTree(t *testing.T, dir string, branch string, parent string, tree string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", "-C", dir, "commit-tree", "-p", parent, "-m", "upstream change", tree)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=rgm", "GIT_AUTHOR_EMAIL=rgm@example.com",
+		"GIT_COMMITTER_NAME=rgm", "GIT_COMMITTER_EMAIL=rgm@example.com")
+	out_bytes, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unable to commit on '%s' in '%s': %v", parent, dir, err)
+	}
+	commit := strings.TrimSpace(string(out_bytes))
+
+	_, err = exec.Command("git", "-C", dir, "update-ref", "refs/heads/"+branch, commit).Output()
+	if err != nil {
+		t.Fatalf("unable to update '%s' in '%s': %v", branch, dir, err)
+	}
+
+	return commit
+}
+
+func TestRpmMirrorDiverged(t *testing.T) {
+	for _, policy := range []rgm.DivergedPolicy{rgm.DivergedSkip, rgm.DivergedReset} {
+		t.Run(string(policy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rgm")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			rpm := "patch"
+			config := setupUpstream(t, dir, rpm, rgm.Config{
+				Origin:   rgm.RemoteConfig{Name: "origin"},
+				Remotes:  []rgm.RemoteConfig{{Name: "fedora"}},
+				Diverged: policy,
+			})
+			path := filepath.Join(dir, "mirror")
+
+			_, err = rgm.RpmMirror(config, rpm, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old_f29 := revParse(t, path, "fedora/f29")
+
+			// f29 is force pushed, f31 is a plain fast-forward
+			upstream := filepath.Join(dir, rpm+".fedora")
+			new_f29 := pushCommit(t, upstream, "f29", "f29~1")
+			new_f31 := pushCommit(t, upstream, "f31", "f31")
+
+			report, err := rgm.RpmMirror(config, rpm, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a diverged branch shouldn't stop the later ones
+			if revParse(t, path, "fedora/f31") != new_f31 {
+				t.Errorf("fedora/f31 wasn't fast-forwarded")
+			}
+
+			f29 := revParse(t, path, "fedora/f29")
+			if policy == rgm.DivergedSkip {
+				if f29 != old_f29 {
+					t.Errorf("fedora/f29 should've been skipped")
+				}
+				// skipped isn't failed, but it is reported
+				status := rgm.BranchStatus("")
+				for _, br := range report.Branches {
+					if br.Name == "fedora/f29" {
+						status = br.Status
+					}
+				}
+				if status != rgm.BranchDiverged {
+					t.Errorf("expected fedora/f29 to be reported as diverged, got '%s'", status)
+				}
+				return
+			}
+
+			if f29 != new_f29 {
+				t.Errorf("fedora/f29 wasn't reset to the remote")
+			}
+
+			out_bytes, err := exec.Command("git", "-C", path, "for-each-ref", "--format=%(objectname)", "refs/rgm/backup/fedora/f29/").Output()
+			if err != nil {
+				t.Fatalf("unable to list backup refs: %v", err)
+			}
+			if strings.TrimSpace(string(out_bytes)) != old_f29 {
+				t.Errorf("old fedora/f29 wasn't backed up, got '%s'", out_bytes)
+			}
+		})
+	}
+}
+
+// A local branch that tracks something else is left alone, without
+// stopping the others.
+func TestRpmMirrorUpstreamConflict(t *testing.T) {
+	dir := t.TempDir()
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old_f29 := revParse(t, path, "fedora/f29")
+
+	_, err = exec.Command("git", "-C", path, "config", "branch.fedora/f29.merge", "refs/heads/f30").Output()
+	if err != nil {
+		t.Fatalf("unable to set the upstream of fedora/f29: %v", err)
+	}
+
+	upstream := filepath.Join(dir, rpm+".fedora")
+	pushCommit(t, upstream, "f29", "f29")
+	new_f31 := pushCommit(t, upstream, "f31", "f31")
+
+	report, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revParse(t, path, "fedora/f29") != old_f29 {
+		t.Errorf("fedora/f29 should've been left alone")
+	}
+	testTrackingBranch(t, path, "fedora/f29", "fedora/f30")
+	if revParse(t, path, "fedora/f31") != new_f31 {
+		t.Errorf("fedora/f31 wasn't fast-forwarded")
+	}
+
+	for _, br := range report.Branches {
+		if br.Name == "fedora/f29" && (br.Status != rgm.BranchConflict || br.Error == "") {
+			t.Errorf("expected fedora/f29 to be reported as a conflict: %+v", br)
+		}
+	}
+}
+
+// Updating the branches shouldn't touch the worktree, except for
+// the checked out branch and then without losing local edits.
+func TestRpmMirrorKeepsWorktree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = exec.Command("git", "-C", path, "checkout", "fedora/f30").Output()
+	if err != nil {
+		t.Fatalf("unable to checkout fedora/f30: %v", err)
+	}
+	readme := filepath.Join(path, "README")
+	err = ioutil.WriteFile(readme, []byte("local edit\n"), 0644)
+	if err != nil {
+		t.Fatalf("unable to edit README: %v", err)
+	}
+
+	upstream := filepath.Join(dir, rpm+".fedora")
+	new_f30 := pushCommit(t, upstream, "f30", "f30")
+	new_f31 := pushCommit(t, upstream, "f31", "f31")
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revParse(t, path, "fedora/f30") != new_f30 {
+		t.Errorf("fedora/f30 wasn't fast-forwarded")
+	}
+	if revParse(t, path, "fedora/f31") != new_f31 {
+		t.Errorf("fedora/f31 wasn't fast-forwarded")
+	}
+
+	out_bytes, err := exec.Command("git", "-C", path, "symbolic-ref", "--short", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("unable to get HEAD: %v", err)
+	}
+	head := strings.TrimSpace(string(out_bytes))
+	if head != "fedora/f30" {
+		t.Errorf("HEAD moved to '%s'", head)
+	}
+
+	data, err := ioutil.ReadFile(readme)
+	if err != nil {
+		t.Fatalf("unable to read README: %v", err)
+	}
+	if string(data) != "local edit\n" {
+		t.Errorf("local edit of README was lost")
+	}
+}
+
+// When the checked out branch can't be moved its files shouldn't
+// move either, or the next run would take them for local edits.
+func TestRpmMirrorLockedHead(t *testing.T) {
+	dir := t.TempDir()
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = exec.Command("git", "-C", path, "checkout", "fedora/f30").Output()
+	if err != nil {
+		t.Fatalf("unable to checkout fedora/f30: %v", err)
+	}
+	// a lock of another git on the ref
+	lock := filepath.Join(path, ".git", "refs", "heads", "fedora", "f30.lock")
+	err = ioutil.WriteFile(lock, nil, 0644)
+	if err != nil {
+		t.Fatalf("unable to lock fedora/f30: %v", err)
+	}
+
+	// f30 gets the README of f31
+	upstream := filepath.Join(dir, rpm+".fedora")
+	pushTree(t, upstream, "f30", "f30", "f31^{tree}")
+
+	// the update may or may not fail (go-git doesn't use the lock),
+	// but the worktree has to match the branch either way
+	rgm.RpmMirror(config, rpm, path)
+
+	out_bytes, err := exec.Command("git", "-C", path, "status", "--porcelain", "--untracked-files=no").Output()
+	if err != nil {
+		t.Fatalf("unable to get the status: %v", err)
+	}
+	if len(out_bytes) != 0 {
+		t.Errorf("the worktree doesn't match fedora/f30: %s", out_bytes)
+	}
+
+	// with the lock gone it is updated
+	err = os.Remove(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revParse(t, path, "fedora/f30") != revParse(t, upstream, "f30") {
+		t.Errorf("fedora/f30 wasn't fast-forwarded")
+	}
+}
+
+func TestRpmMirrorBare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+		Bare:    true,
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revParse(t, path, "--is-bare-repository") != "true" {
+		t.Fatalf("'%s' isn't a bare repo", path)
+	}
+	testRefExists(t, path, "refs/heads/fedora/f31", true)
+
+	upstream := filepath.Join(dir, rpm+".fedora")
+	new_f31 := pushCommit(t, upstream, "f31", "f31")
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revParse(t, path, "fedora/f31") != new_f31 {
+		t.Errorf("fedora/f31 wasn't fast-forwarded")
+	}
+}
+
+// Start a server that accepts connections but never answers, like
+// a hung git server.  Returns its URL and a func to stop it.
+func stalledServer(t *testing.T) (string, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	stop := func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+
+	return fmt.Sprintf("http://%s/patch.git", ln.Addr()), stop
+}
+
+// A stalled remote should be stopped after its timeout while the
+// others still get mirrored.
+func TestRpmMirrorTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	url, stop := stalledServer(t)
+	defer stop()
+
+	cfg := rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", URL: "testdata/{{.RPM}}.fedora"},
+			{Name: "stalled", URL: url, Timeout: rgm.Duration(500 * time.Millisecond)},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rgm.RpmMirrorConfig(cfg, "patch", dir)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		// libgit2 can't always stop while it waits on the network,
+		// then the whole mirror fails since it could still write to
+		// the repo
+		if err != nil && strings.Contains(err.Error(), "abandoned") && rgm.DefaultBackend() == "libgit2" {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("stalled remote wasn't stopped")
+	}
+
+	testRefExists(t, dir, "refs/heads/fedora/f31", true)
+}
+
+func TestRpmMirrorCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = rgm.RpmMirrorContext(ctx, "testdata/config.json", "patch", dir)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the mirror to be canceled, got: %v", err)
+	}
 }
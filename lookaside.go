@@ -0,0 +1,97 @@
+package rgm
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Where the sources are served by LookasideHandler, the same place
+// as on the lookaside cache of Fedora.
+const LookasidePrefix = "/repo/pkgs/"
+
+// Parse the path of a source in a lookaside cache, after the
+// LookasidePrefix.  The RPM (and the namespace in front of it that
+// newer fedpkg adds) isn't needed since the cache is by hash.
+//
+//	patch/patch-2.7.6.tar.xz/sha512/fcca87bd.../patch-2.7.6.tar.xz
+//	patch/patch-2.7.6.tar.xz/4c68cee9.../patch-2.7.6.tar.xz  (old, md5)
+//	rpms/patch/patch-2.7.6.tar.xz/sha512/fcca87bd.../patch-2.7.6.tar.xz
+func parseLookasidePath(path string) (Source, bool) {
+	parts := strings.Split(path, "/")
+
+	src, ok := parseLookasideParts(parts)
+	if !ok && len(parts) > 4 {
+		src, ok = parseLookasideParts(parts[1:])
+	}
+
+	return src, ok
+}
+
+// Parse the parts of a lookaside path that start with the RPM.
+func parseLookasideParts(parts []string) (Source, bool) {
+	var src Source
+	switch len(parts) {
+	case 5:
+		src = Source{Filename: parts[1], HashType: strings.ToLower(parts[2]), Hash: strings.ToLower(parts[3])}
+	case 4:
+		src = Source{Filename: parts[1], HashType: "md5", Hash: strings.ToLower(parts[2])}
+	default:
+		return Source{}, false
+	}
+	if parts[0] == "" || parts[len(parts)-1] != src.Filename || src.check() != nil {
+		return Source{}, false
+	}
+
+	return src, true
+}
+
+// Serve the sources in a cache (see Config.SourcesCache) in the same
+// layout as a dist-git lookaside cache, so that fedpkg or centpkg (or
+// the Lookaside of another mirror) can get them from it.
+//
+//	/repo/pkgs/<rpm>/<file>/<hashtype>/<hash>/<file>
+//	/repo/pkgs/<rpm>/<file>/<md5>/<file>
+//	/repo/pkgs/<namespace>/<rpm>/...  (e.g. rpms/patch/...)
+//
+// A source that isn't in the cache is not found, nothing is ever
+// downloaded.
+func LookasideHandler(cache string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, LookasidePrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		src, ok := parseLookasidePath(strings.TrimPrefix(r.URL.Path, LookasidePrefix))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := os.Open(src.CachePath(cache))
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, src.Filename, info.ModTime(), file)
+	})
+}
@@ -0,0 +1,117 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Put a source in a cache, like a download would.
+func cacheSource(t *testing.T, cache string, src rgm.Source, data string) {
+	t.Helper()
+
+	path := src.CachePath(cache)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookasideHandler(t *testing.T) {
+	cache := t.TempDir()
+	tarball := rgm.Source{Filename: "patch-2.7.6.tar.xz", HashType: "sha512", Hash: sha512Hex("the patch tarball")}
+	sig := rgm.Source{Filename: "patch.sig", HashType: "md5", Hash: md5Hex("a signature")}
+	cacheSource(t, cache, tarball, "the patch tarball")
+	cacheSource(t, cache, sig, "a signature")
+
+	server := httptest.NewServer(rgm.LookasideHandler(cache))
+	defer server.Close()
+
+	missing := sha512Hex("not in the cache")
+	cases := []struct {
+		Method string
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"GET", "/repo/pkgs/patch/patch-2.7.6.tar.xz/sha512/" + tarball.Hash + "/patch-2.7.6.tar.xz", 200, "the patch tarball"},
+		{"HEAD", "/repo/pkgs/patch/patch-2.7.6.tar.xz/sha512/" + tarball.Hash + "/patch-2.7.6.tar.xz", 200, ""},
+		{"GET", "/repo/pkgs/patch/patch.sig/md5/" + sig.Hash + "/patch.sig", 200, "a signature"},
+		// the old layout, without the hash type
+		{"GET", "/repo/pkgs/patch/patch.sig/" + sig.Hash + "/patch.sig", 200, "a signature"},
+		// with the namespace of a newer fedpkg
+		{"GET", "/repo/pkgs/rpms/patch/patch-2.7.6.tar.xz/sha512/" + tarball.Hash + "/patch-2.7.6.tar.xz", 200, "the patch tarball"},
+		{"GET", "/repo/pkgs/rpms/patch/patch.sig/" + sig.Hash + "/patch.sig", 200, "a signature"},
+		{"GET", "/repo/pkgs/a/b/patch/patch.sig/" + sig.Hash + "/patch.sig", 404, ""},
+		{"GET", "/repo/pkgs/patch/patch-2.7.6.tar.xz/sha512/" + missing + "/patch-2.7.6.tar.xz", 404, ""},
+		{"GET", "/repo/pkgs/patch/patch-2.7.6.tar.xz/sha512/" + tarball.Hash + "/other.tar.xz", 404, ""},
+		{"GET", "/repo/pkgs/patch/patch-2.7.6.tar.xz/sha3/" + tarball.Hash + "/patch-2.7.6.tar.xz", 404, ""},
+		{"GET", "/repo/pkgs/patch/patch.sig/md5/../patch.sig", 404, ""},
+		{"GET", "/sha512/" + tarball.Hash, 404, ""},
+		{"POST", "/repo/pkgs/patch/patch.sig/md5/" + sig.Hash + "/patch.sig", 405, ""},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.Method, server.URL+c.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s '%s' failed: %v", c.Method, c.Path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != c.Status {
+			t.Errorf("expected %d for %s '%s', got %d", c.Status, c.Method, c.Path, resp.StatusCode)
+			continue
+		}
+		if c.Status == 200 && string(body) != c.Body {
+			t.Errorf("unexpected body for %s '%s': %q", c.Method, c.Path, body)
+		}
+	}
+}
+
+func TestRpmMirrorFromLookasideHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	// the sources of one mirror are the lookaside cache of another
+	served := filepath.Join(dir, "served")
+	tarball := rgm.Source{Filename: "patch-2.7.6.tar.xz", HashType: "sha512", Hash: sha512Hex("the patch tarball")}
+	cacheSource(t, served, tarball, "the patch tarball")
+	server := httptest.NewServer(rgm.LookasideHandler(served))
+	defer server.Close()
+
+	rpm := "patch"
+	cache := filepath.Join(dir, "sources")
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", Lookaside: server.URL + rgm.LookasidePrefix + "{{.Name}}/{{.Filename}}/{{.HashType}}/{{.Hash}}/{{.Filename}}"},
+		},
+		SourcesCache: cache,
+	})
+	pushFile(t, filepath.Join(dir, rpm+".fedora"), "f31", "sources", "SHA512 (patch-2.7.6.tar.xz) = "+tarball.Hash+"\n")
+
+	_, err := rgm.RpmMirror(config, rpm, filepath.Join(dir, "mirror"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(tarball.CachePath(cache))
+	if err != nil || string(data) != "the patch tarball" {
+		t.Errorf("expected the tarball from the other cache, got %q: %v", data, err)
+	}
+}
@@ -0,0 +1,349 @@
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The mirror of an RPM, made from a Config (template) and the name
+// of the RPM.  The steps of RpmMirror are its methods so they can
+// also be run on their own.
+//
+//	m, err := NewMirror(cfg, "patch", "patch.rpm", Options{})
+//	...
+//	defer m.Close()
+//	err = m.Init(ctx)          // open or clone
+//	err = m.SyncRemotes(ctx)   // add/fix the remotes
+//	err = m.Fetch(ctx)
+//	err = m.SyncBranches()     // create/prune the local branches
+//	err = m.Update(ctx)        // fast-forward the local branches
+//	err = m.Sources(ctx)       // only with a SourcesCache
+//
+// The same Config can be used for any number of mirrors.
+type Mirror struct {
+	Rpm  string
+	Path string
+	// The config with the template executed for the RPM.  The
+	// URLs that answered are recorded in it as the steps are run.
+	Config Config
+
+	backend backend
+	repo    repository
+	run     *mirrorRun
+}
+
+// Make a mirror of the RPM at path, the config is checked with
+// Validate first.  Nothing is opened or cloned until Open or Init is
+// called.
+func NewMirror(cfg_tmpl Config, rpm string, path string, opts Options) (*Mirror, error) {
+	err := cfg_tmpl.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	cfg, err := ExecConfigTemplate(cfg_tmpl, rpm)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setRetryDefaults()
+
+	be, err := getBackend(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mirror{
+		Rpm:     rpm,
+		Path:    path,
+		Config:  cfg,
+		backend: be,
+		run: &mirrorRun{
+			opts:   opts,
+			report: &Report{Rpm: rpm, Path: path, Start: time.Now()},
+		},
+	}, nil
+}
+
+// Open an existing mirror.
+func (m *Mirror) Open() error {
+	if m.repo != nil {
+		return nil
+	}
+
+	repo, err := m.backend.Open(m.Path)
+	if err != nil {
+		return fmt.Errorf("unable to open mirror '%s': %v", m.Path, err)
+	}
+	m.repo = repo
+
+	return nil
+}
+
+// Open the mirror if it exists, otherwise clone it from the first
+// of the origin URLs that works.
+func (m *Mirror) Init(ctx context.Context) error {
+	if m.repo != nil {
+		return nil
+	}
+
+	repo, err := openOrCloneRpm(ctx, m.backend, &m.Config.Origin, m.Path, m.Config.Bare, m.run)
+	if err != nil {
+		return err
+	}
+	m.repo = repo
+
+	return nil
+}
+
+// Free the repo, the mirror can be opened again afterwards.
+func (m *Mirror) Close() {
+	if m.repo != nil {
+		m.repo.Free()
+		m.repo = nil
+	}
+}
+
+func (m *Mirror) checkOpen() error {
+	if m.repo == nil {
+		return fmt.Errorf("mirror '%s' isn't open", m.Path)
+	}
+
+	return nil
+}
+
+// All the remotes of the config, the origin first.
+func (m *Mirror) remoteConfigs() []RemoteConfig {
+	return append([]RemoteConfig{m.Config.Origin}, m.Config.Remotes...)
+}
+
+// Reconcile the remotes of the repo with the config: add missing
+// ones, fix changed URLs and set up pruning.
+func (m *Mirror) SyncRemotes(ctx context.Context) error {
+	if err := m.checkOpen(); err != nil {
+		return err
+	}
+
+	// The origin may have moved too, so it is reconciled
+	// along with the other remotes.  Its tags are kept apart as
+	// well.
+	err := setupRpmRemote(ctx, m.repo, &m.Config.Origin, m.run)
+	if err != nil {
+		return err
+	}
+	err = setupRemoteTags(m.repo, m.Config.Origin.Name)
+	if err != nil {
+		return err
+	}
+
+	err = setupRpmRemotes(ctx, m.repo, m.Config.Remotes, m.run)
+	if err != nil {
+		return err
+	}
+
+	return setupPrune(m.repo, m.Config.Prune)
+}
+
+// Fetch all the remotes, see FetchAllContext.
+func (m *Mirror) Fetch(ctx context.Context) error {
+	if err := m.checkOpen(); err != nil {
+		return err
+	}
+
+	return fetchAll(ctx, m.repo, m.remoteConfigs(), m.run)
+}
+
+// Prune the local branches whose remote branch is gone (according
+// to the Prune policy), create the missing ones and point the
+// release aliases at them.
+func (m *Mirror) SyncBranches() error {
+	if err := m.checkOpen(); err != nil {
+		return err
+	}
+
+	err := pruneRpmBranches(m.repo, m.Config.Prune, m.run)
+	if err != nil {
+		return err
+	}
+
+	err = setupRpmBranches(m.repo, m.remoteConfigs(), m.run)
+	if err != nil {
+		return err
+	}
+
+	return setupReleaseAliases(m.repo, m.Config.Releases, m.remoteConfigs(), m.run)
+}
+
+// Bring the local branches up to what was last fetched, handling
+// the diverged ones according to the Diverged policy.
+func (m *Mirror) Update(ctx context.Context) error {
+	if err := m.checkOpen(); err != nil {
+		return err
+	}
+
+	return pullBranches(ctx, m.repo, m.remoteConfigs(), m.Config.Diverged, m.run)
+}
+
+// Download the sources of the local branches, the ones in the dist-git
+// sources file of each, from the Lookaside of their remote in to the
+// SourcesCache.  The sources that are already there aren't downloaded
+// again and the branches of the remotes without a Lookaside are
+// skipped.
+func (m *Mirror) Sources(ctx context.Context) error {
+	if err := m.checkOpen(); err != nil {
+		return err
+	}
+	if m.Config.SourcesCache == "" {
+		return fmt.Errorf("no SourcesCache to download the sources to")
+	}
+
+	return downloadSources(ctx, m.repo, m.remoteConfigs(), m.Rpm, m.Config.SourcesCache, m.run)
+}
+
+// Run all the steps, like RpmMirror.
+func (m *Mirror) Run(ctx context.Context) (*Report, error) {
+	err := m.runSteps(ctx)
+
+	report := m.Report()
+	report.Duration = Duration(time.Since(report.Start))
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	return report, err
+}
+
+func (m *Mirror) runSteps(ctx context.Context) error {
+	err := m.Init(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = m.SyncRemotes(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = m.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = m.SyncBranches()
+	if err != nil {
+		return err
+	}
+
+	// everything was just fetched so only the pull part is needed
+	err = m.Update(ctx)
+	if m.Config.SourcesCache == "" || ctx.Err() != nil {
+		return err
+	}
+
+	// the branches that were updated still get their sources
+	sources_err := m.Sources(ctx)
+	if err != nil {
+		return err
+	}
+
+	return sources_err
+}
+
+// The report of the steps that were run so far.
+func (m *Mirror) Report() *Report {
+	return m.run.report
+}
+
+// Compare each local branch with its remote branch, as of the last
+// fetch, without changing anything.
+//
+//	fedora/f30  up-to-date
+//	fedora/f31  behind      (a fast-forward away)
+//	fedora/f32  missing     (not created yet)
+//	fedora/f29  gone        (deleted upstream)
+func (m *Mirror) Status() ([]BranchReport, error) {
+	if err := m.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	branches, err := getExpectedLocalBranches(m.repo, m.remoteConfigs())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get branches: %v", err)
+	}
+
+	var status []BranchReport
+	for _, bm := range branches {
+		br, err := branchStatus(m.repo, bm)
+		if err != nil {
+			return nil, err
+		}
+		status = append(status, br)
+	}
+
+	dead, err := getDeadLocalBranches(m.repo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get branches: %v", err)
+	}
+	for _, branch := range dead {
+		target, err := m.repo.BranchTarget(branch, localBranch)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lookup branch '%s': %v", branch, err)
+		}
+		status = append(status, BranchReport{
+			Name:   branch,
+			Status: BranchGone,
+			OldOid: target,
+		})
+	}
+
+	return status, nil
+}
+
+// The status of a local branch compared to its remote branch, OldOid
+// is the local one and NewOid the remote one.
+func branchStatus(repo repository, bm branchMapping) (BranchReport, error) {
+	branch := bm.local
+	br := BranchReport{Name: branch}
+
+	remote_oid, err := repo.BranchTarget(bm.tracking(), remoteBranch)
+	if err != nil {
+		return br, fmt.Errorf("unable to lookup remote branch '%s': %v", bm.tracking(), err)
+	}
+	br.NewOid = remote_oid
+
+	local_oid, err := repo.BranchTarget(branch, localBranch)
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			return br, fmt.Errorf("unable to lookup branch '%s': %v", branch, err)
+		}
+		br.Status = BranchMissing
+		return br, nil
+	}
+	br.OldOid = local_oid
+
+	if local_oid == remote_oid {
+		br.Status = BranchUpToDate
+		return br, nil
+	}
+
+	ahead, err := repo.DescendantOf(local_oid, remote_oid)
+	if err != nil {
+		return br, fmt.Errorf("unable to compare '%s' with its remote: %v", branch, err)
+	}
+	behind, err := repo.DescendantOf(remote_oid, local_oid)
+	if err != nil {
+		return br, fmt.Errorf("unable to compare '%s' with its remote: %v", branch, err)
+	}
+
+	switch {
+	case ahead:
+		br.Status = BranchAhead
+	case behind:
+		br.Status = BranchBehind
+	default:
+		br.Status = BranchDiverged
+	}
+
+	return br, nil
+}
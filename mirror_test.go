@@ -0,0 +1,132 @@
+package rgm_test
+
+import (
+	"context"
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func statusOf(t *testing.T, m *rgm.Mirror) map[string]rgm.BranchStatus {
+	t.Helper()
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatalf("unable to get status: %v", err)
+	}
+
+	branches := make(map[string]rgm.BranchStatus)
+	for _, br := range status {
+		branches[br.Name] = br.Status
+	}
+
+	return branches
+}
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+	})
+	cfg, err := rgm.LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "mirror")
+	ctx := context.Background()
+
+	m, err := rgm.NewMirror(cfg, rpm, path, rgm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// nothing there to open yet
+	if err = m.Open(); err == nil {
+		t.Errorf("expected Open of a missing mirror to fail")
+	}
+	if err = m.Fetch(ctx); err == nil {
+		t.Errorf("expected Fetch before Init to fail")
+	}
+
+	err = m.Init(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SyncRemotes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tags of the origin are kept apart like the other remotes
+	out, err := exec.Command("git", "-C", path, "config", "--get-all", "remote.origin.fetch").Output()
+	if err != nil || !strings.Contains(string(out), "+refs/tags/*:refs/tags/origin/*") {
+		t.Errorf("expected the tags refspec on the origin, got '%s': %v", out, err)
+	}
+
+	err = m.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := statusOf(t, m); status["fedora/f31"] != rgm.BranchMissing {
+		t.Errorf("expected fedora/f31 to be missing before SyncBranches: %v", status)
+	}
+
+	err = m.SyncBranches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, status := range statusOf(t, m) {
+		if status != rgm.BranchUpToDate {
+			t.Errorf("expected '%s' to be up-to-date, got '%s'", name, status)
+		}
+	}
+
+	new_f31 := pushCommit(t, filepath.Join(dir, rpm+".fedora"), "f31", "f31")
+	err = m.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := statusOf(t, m); status["fedora/f31"] != rgm.BranchBehind {
+		t.Errorf("expected fedora/f31 to be behind after the fetch: %v", status)
+	}
+
+	err = m.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := statusOf(t, m); status["fedora/f31"] != rgm.BranchUpToDate {
+		t.Errorf("expected fedora/f31 to be up-to-date after Update: %v", status)
+	}
+	if revParse(t, path, "fedora/f31") != new_f31 {
+		t.Errorf("fedora/f31 wasn't fast-forwarded")
+	}
+
+	br := findBranchReport(t, m.Report(), "fedora/f31")
+	if br.Status != rgm.BranchFastForwarded || br.NewOid != new_f31 {
+		t.Errorf("expected the fast-forward in the report: %+v", br)
+	}
+
+	// a second mirror of the same config can open the existing repo
+	m2, err := rgm.NewMirror(cfg, rpm, path, rgm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Close()
+	err = m2.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package rgm
+
+import (
+	"log/slog"
+)
+
+// Progress of a fetch (or clone) from a remote, as reported by
+// libgit2 while the objects are received and indexed.
+type FetchProgress struct {
+	Remote          string
+	TotalObjects    uint
+	ReceivedObjects uint
+	IndexedObjects  uint
+	ReceivedBytes   uint
+}
+
+// Done once every object has been received and indexed.
+func (p FetchProgress) Done() bool {
+	return p.TotalObjects > 0 && p.IndexedObjects == p.TotalObjects
+}
+
+// Options for embedding a mirror run in a program.  The zero value
+// logs to slog.Default() and reports no progress.
+type Options struct {
+	// Where problems (e.g. a remote that can't be fetched) and
+	// retries are logged.  Every record has the "rpm" attribute.
+	Logger *slog.Logger
+	// Called as the objects of a remote are received.  It is called
+	// often and from the goroutine doing the transfer, so it should
+	// return quickly.  The libgit2 and exec backends report it,
+	// go-git doesn't.
+	FetchProgress func(FetchProgress)
+	// Called when a local branch is created, fast-forwarded, reset,
+	// pruned or can't be updated.  Branches that were already up to
+	// date are only in the Report.
+	BranchUpdate func(BranchReport)
+}
+
+// The state of one mirror run, the options it was started with and
+// the report of what was done so far.
+//
+// The free functions (SetupRpmRemotes, FetchAll, ...) don't have a
+// run so, like Report, a nil mirrorRun is valid and uses the
+// defaults.
+type mirrorRun struct {
+	opts   Options
+	report *Report
+}
+
+func (run *mirrorRun) logger() *slog.Logger {
+	if run == nil {
+		return slog.Default()
+	}
+
+	logger := run.opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return logger.With("rpm", run.report.Rpm)
+}
+
+func (run *mirrorRun) remote(name string) *RemoteReport {
+	if run == nil {
+		return (*Report)(nil).remote(name)
+	}
+
+	return run.report.remote(name)
+}
+
+func (run *mirrorRun) branch(name string) *BranchReport {
+	if run == nil {
+		return (*Report)(nil).branch(name)
+	}
+
+	return run.report.branch(name)
+}
+
+func (run *mirrorRun) source(branch string, src Source) *SourceReport {
+	if run == nil {
+		return (*Report)(nil).source(branch, src)
+	}
+
+	return run.report.source(branch, src)
+}
+
+func (run *mirrorRun) branchUpdate(br *BranchReport) {
+	if run == nil || run.opts.BranchUpdate == nil {
+		return
+	}
+
+	run.opts.BranchUpdate(*br)
+}
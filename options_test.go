@@ -0,0 +1,77 @@
+package rgm_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRpmMirrorOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logs bytes.Buffer
+	var mu sync.Mutex
+	progress := make(map[string]rgm.FetchProgress)
+	var updates []rgm.BranchReport
+
+	opts := rgm.Options{
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+		FetchProgress: func(prog rgm.FetchProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress[prog.Remote] = prog
+		},
+		BranchUpdate: func(br rgm.BranchReport) {
+			updates = append(updates, br)
+		},
+	}
+
+	cfg := rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", URL: "testdata/{{.RPM}}.fedora"},
+			{Name: "missing", URL: "testdata/{{.RPM}}.missing"},
+		},
+	}
+	path := filepath.Join(dir, "mirror")
+
+	_, err = rgm.RpmMirrorOptions(context.Background(), cfg, "patch", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the missing remote is logged with the rpm and remote attributes
+	out := logs.String()
+	if !strings.Contains(out, "rpm=patch") || !strings.Contains(out, "remote=missing") {
+		t.Errorf("expected the missing remote in the log: %s", out)
+	}
+
+	// go-git doesn't report the fetch progress
+	mu.Lock()
+	prog, ok := progress["fedora"]
+	mu.Unlock()
+	if rgm.DefaultBackend() != "go-git" && (!ok || !prog.Done()) {
+		t.Errorf("expected the fetch progress of fedora to be done: %+v", progress)
+	}
+
+	found := false
+	for _, br := range updates {
+		if br.Name == "fedora/f31" && br.Status == rgm.BranchCreated {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected fedora/f31 to be created: %+v", updates)
+	}
+}
@@ -0,0 +1,100 @@
+package rgm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Where the release aliases are kept, see Config.Releases.
+const releasePrefix = "refs/heads/release/"
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Point each alias of a release at the local branch that mirrors its
+// <remote>/<branch>, whatever the branch is named locally.
+//
+//	refs/heads/release/el8/centos -> refs/heads/centos/c8s
+//
+// An alias of a branch that isn't mirrored (e.g. it was pruned or
+// filtered out) is removed.  A ref that isn't an alias, such as a
+// branch of its own, is left alone.
+func setupReleaseAliases(repo repository, releases map[string]map[string]string, rcs []RemoteConfig, run *mirrorRun) error {
+	if len(releases) == 0 {
+		return nil
+	}
+
+	branches, err := getExpectedLocalBranches(repo, rcs)
+	if err != nil {
+		return fmt.Errorf("unable to get branches: %v", err)
+	}
+	locals := make(map[string]string)
+	for _, bm := range branches {
+		locals[bm.tracking()] = bm.local
+	}
+
+	release_names := make([]string, 0, len(releases))
+	for release := range releases {
+		release_names = append(release_names, release)
+	}
+	sort.Strings(release_names)
+
+	for _, release := range release_names {
+		aliases := releases[release]
+		for _, alias := range sortedKeys(aliases) {
+			tracking := aliases[alias] // centos/c8s
+			name := releasePrefix + release + "/" + alias
+
+			current, err := repo.SymbolicRef(name)
+			exists := err == nil
+			if err != nil && !errors.Is(err, errNotFound) {
+				return fmt.Errorf("unable to lookup '%s': %v", name, err)
+			}
+			if exists && current == "" {
+				run.logger().Warn("not an alias, left alone", "ref", name)
+				continue
+			}
+
+			// the local branch may not have been created
+			local, ok := locals[tracking]
+			if ok {
+				_, err = repo.BranchTarget(local, localBranch)
+				if err != nil && !errors.Is(err, errNotFound) {
+					return fmt.Errorf("unable to lookup branch '%s': %v", local, err)
+				}
+				ok = err == nil
+			}
+
+			if !ok {
+				if exists {
+					err = repo.DeleteRef(name)
+					if err != nil {
+						return fmt.Errorf("unable to remove alias '%s': %v", name, err)
+					}
+					run.logger().Info("removed alias, its branch isn't mirrored", "ref", name, "branch", tracking)
+				}
+				continue
+			}
+
+			target := "refs/heads/" + local
+			if current == target {
+				continue
+			}
+			err = repo.CreateSymbolicRef(name, target, "release: alias of "+tracking)
+			if err != nil {
+				return fmt.Errorf("unable to set alias '%s' to '%s': %v", name, target, err)
+			}
+			run.logger().Info("set alias", "ref", name, "target", target)
+		}
+	}
+
+	return nil
+}
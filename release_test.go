@@ -0,0 +1,76 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testAlias(t *testing.T, dir string, alias string, target string) {
+	t.Helper()
+
+	out_bytes, err := exec.Command("git", "-C", dir, "symbolic-ref", "--quiet", alias).Output()
+	out := strings.TrimSpace(string(out_bytes))
+	if target == "" {
+		if err == nil {
+			t.Errorf("expected no alias '%s', it points to '%s'", alias, out)
+		}
+		return
+	}
+	if err != nil || out != target {
+		t.Errorf("expected alias '%s' to point to '%s', got '%s': %v", alias, target, out, err)
+	}
+}
+
+func TestRpmMirrorReleases(t *testing.T) {
+	dir := t.TempDir()
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", BranchName: `dist/{{.Remote}}/{{.Branch | trimPrefix "f"}}`},
+			{Name: "centos"},
+		},
+		Releases: map[string]map[string]string{
+			"el7":     {"centos": "centos/c7", "fedora": "fedora/f31"},
+			"el6":     {"centos": "centos/c6"},
+			"missing": {"centos": "centos/c9"},
+		},
+		Prune: rgm.PruneDelete,
+	})
+	path := filepath.Join(dir, "mirror")
+
+	_, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAlias(t, path, "refs/heads/release/el7/centos", "refs/heads/centos/c7")
+	testAlias(t, path, "refs/heads/release/el7/fedora", "refs/heads/dist/fedora/31")
+	testAlias(t, path, "refs/heads/release/el6/centos", "refs/heads/centos/c6")
+	testAlias(t, path, "refs/heads/release/missing/centos", "")
+
+	// an alias gives the commit of its branch
+	if revParse(t, path, "release/el7/centos") != revParse(t, path, "refs/heads/centos/c7") {
+		t.Errorf("expected release/el7/centos to be centos/c7")
+	}
+
+	// centos retires c6 so its alias goes away with the branch
+	upstream := filepath.Join(dir, rpm+".centos")
+	_, err = exec.Command("git", "-C", upstream, "branch", "-D", "c6").Output()
+	if err != nil {
+		t.Fatalf("unable to delete upstream branch: %v", err)
+	}
+
+	_, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRefExists(t, path, "refs/heads/centos/c6", false)
+	testAlias(t, path, "refs/heads/release/el6/centos", "")
+	testAlias(t, path, "refs/heads/release/el7/centos", "refs/heads/centos/c7")
+}
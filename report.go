@@ -0,0 +1,135 @@
+package rgm
+
+import (
+	"time"
+)
+
+// What happened to a local branch during a run.
+type BranchStatus string
+
+const (
+	BranchCreated       BranchStatus = "created"
+	BranchFastForwarded BranchStatus = "fast-forwarded"
+	BranchUpToDate      BranchStatus = "up-to-date"
+	BranchDiverged      BranchStatus = "diverged" // rewritten upstream, skipped
+	BranchReset         BranchStatus = "reset"    // rewritten upstream, reset to it
+	BranchPruned        BranchStatus = "pruned"
+	BranchArchived      BranchStatus = "archived"
+	BranchConflict      BranchStatus = "conflict" // tracks another upstream, left alone
+	BranchFailed        BranchStatus = "failed"
+
+	// Only from Mirror.Status, which doesn't change anything.
+	BranchMissing BranchStatus = "missing" // no local branch yet
+	BranchBehind  BranchStatus = "behind"  // can be fast-forwarded
+	BranchAhead   BranchStatus = "ahead"   // has commits the remote doesn't
+	BranchGone    BranchStatus = "gone"    // the remote branch was deleted
+)
+
+// What happened to a source of a branch, see Mirror.Sources.
+type SourceStatus string
+
+const (
+	SourceDownloaded SourceStatus = "downloaded"
+	SourceCached     SourceStatus = "cached" // already downloaded
+	SourceFailed     SourceStatus = "failed"
+)
+
+// What happened to a remote during a run.
+type RemoteReport struct {
+	Name       string
+	URL        string `json:",omitempty"`
+	Configured bool
+	Fetched    bool
+	Error      string   `json:",omitempty"`
+	FetchTime  Duration `json:",omitempty"`
+}
+
+// What happened to a local branch during a run.  The OIDs are the
+// commit the branch was at before and after.
+type BranchReport struct {
+	Name   string
+	Status BranchStatus
+	OldOid string `json:",omitempty"`
+	NewOid string `json:",omitempty"`
+	Backup string `json:",omitempty"` // ref with the old tip of a reset
+	Error  string `json:",omitempty"`
+}
+
+// What happened to a source of a local branch during a run.
+type SourceReport struct {
+	Branch   string
+	Filename string
+	HashType string `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+	Status   SourceStatus
+	Error    string `json:",omitempty"`
+}
+
+// The result of mirroring an RPM, which remotes were fetched and
+// how each branch was updated.
+//
+// It is meant to be read by programs (and printed as JSON), the
+// same problems are also logged as they happen.
+type Report struct {
+	Rpm      string
+	Path     string
+	Cloned   bool
+	Remotes  []RemoteReport
+	Branches []BranchReport
+	Sources  []SourceReport `json:",omitempty"`
+	Start    time.Time
+	Duration Duration
+	Error    string `json:",omitempty"`
+}
+
+// Get the report of a remote, adding it if it is new.
+//
+// Reporting is optional so a nil Report hands out a throwaway
+// entry, that way callers don't have to check.
+func (r *Report) remote(name string) *RemoteReport {
+	if r == nil {
+		return &RemoteReport{Name: name}
+	}
+
+	for i := range r.Remotes {
+		if r.Remotes[i].Name == name {
+			return &r.Remotes[i]
+		}
+	}
+	r.Remotes = append(r.Remotes, RemoteReport{Name: name})
+
+	return &r.Remotes[len(r.Remotes)-1]
+}
+
+// Get the report of a branch, adding it if it is new (see remote).
+func (r *Report) branch(name string) *BranchReport {
+	if r == nil {
+		return &BranchReport{Name: name}
+	}
+
+	for i := range r.Branches {
+		if r.Branches[i].Name == name {
+			return &r.Branches[i]
+		}
+	}
+	r.Branches = append(r.Branches, BranchReport{Name: name})
+
+	return &r.Branches[len(r.Branches)-1]
+}
+
+// Get the report of a source of a branch, adding it if it is new (see
+// remote).
+func (r *Report) source(branch string, src Source) *SourceReport {
+	if r == nil {
+		return &SourceReport{Branch: branch, Filename: src.Filename}
+	}
+
+	for i := range r.Sources {
+		if r.Sources[i].Branch == branch && r.Sources[i].Filename == src.Filename {
+			return &r.Sources[i]
+		}
+	}
+	r.Sources = append(r.Sources, SourceReport{Branch: branch, Filename: src.Filename, HashType: src.HashType, Hash: src.Hash})
+
+	return &r.Sources[len(r.Sources)-1]
+}
@@ -0,0 +1,103 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func findBranchReport(t *testing.T, report *rgm.Report, name string) rgm.BranchReport {
+	t.Helper()
+
+	for _, br := range report.Branches {
+		if br.Name == name {
+			return br
+		}
+	}
+	t.Fatalf("no report for branch '%s': %+v", name, report.Branches)
+
+	return rgm.BranchReport{}
+}
+
+func findRemoteReport(t *testing.T, report *rgm.Report, name string) rgm.RemoteReport {
+	t.Helper()
+
+	for _, rr := range report.Remotes {
+		if rr.Name == name {
+			return rr
+		}
+	}
+	t.Fatalf("no report for remote '%s': %+v", name, report.Remotes)
+
+	return rgm.RemoteReport{}
+}
+
+func TestRpmMirrorReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "fedora"}},
+	})
+	path := filepath.Join(dir, "mirror")
+
+	report, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Cloned || report.Error != "" {
+		t.Errorf("expected a clean clone: %+v", report)
+	}
+	for _, name := range []string{"origin", "fedora"} {
+		rr := findRemoteReport(t, report, name)
+		if !rr.Configured || !rr.Fetched || rr.Error != "" {
+			t.Errorf("expected '%s' to be configured and fetched: %+v", name, rr)
+		}
+	}
+	br := findBranchReport(t, report, "fedora/f31")
+	if br.Status != rgm.BranchCreated || br.NewOid != revParse(t, path, "fedora/f31") {
+		t.Errorf("expected fedora/f31 to be created: %+v", br)
+	}
+
+	old_f31 := revParse(t, path, "fedora/f31")
+	new_f31 := pushCommit(t, filepath.Join(dir, rpm+".fedora"), "f31", "f31")
+
+	report, err = rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Cloned {
+		t.Errorf("existing mirror reported as cloned")
+	}
+	br = findBranchReport(t, report, "fedora/f31")
+	if br.Status != rgm.BranchFastForwarded || br.OldOid != old_f31 || br.NewOid != new_f31 {
+		t.Errorf("expected fedora/f31 to be fast-forwarded from %s to %s: %+v", old_f31, new_f31, br)
+	}
+	br = findBranchReport(t, report, "fedora/f30")
+	if br.Status != rgm.BranchUpToDate {
+		t.Errorf("expected fedora/f30 to be up to date: %+v", br)
+	}
+}
+
+func TestRpmMirrorReportError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	report, err := rgm.RpmMirror("testdata/config.json", "badrpmXXX", dir)
+	if err == nil {
+		t.Fatalf("mirror of a bad rpm should've failed")
+	}
+	if report == nil || report.Error != err.Error() || report.Rpm != "badrpmXXX" {
+		t.Errorf("expected the error in the report: %+v", report)
+	}
+}
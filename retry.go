@@ -0,0 +1,122 @@
+package rgm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// How often and how fast to retry a fetch, clone or download that failed
+// with a transient error (see IsRetryable).
+//
+//	"Retry": {"Retries": 3, "Backoff": "2s", "MaxBackoff": "1m"}
+//
+// The wait doubles after each attempt, starting at Backoff and up
+// to MaxBackoff.
+type RetryConfig struct {
+	Retries    int
+	Backoff    Duration
+	MaxBackoff Duration
+}
+
+const (
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// How long to wait before the given retry (starting at 0).
+func (rc RetryConfig) backoff(retry int) time.Duration {
+	backoff := time.Duration(rc.Backoff)
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	max_backoff := time.Duration(rc.MaxBackoff)
+	if max_backoff <= 0 {
+		max_backoff = defaultMaxBackoff
+	}
+
+	for i := 0; i < retry && backoff < max_backoff; i++ {
+		backoff *= 2
+	}
+	if backoff > max_backoff {
+		backoff = max_backoff
+	}
+
+	return backoff
+}
+
+// Give the remotes without their own retry settings the global ones.
+func (cfg *Config) setRetryDefaults() {
+	if cfg.Origin.Retry == nil {
+		cfg.Origin.Retry = &cfg.Retry
+	}
+	for i := range cfg.Remotes {
+		if cfg.Remotes[i].Retry == nil {
+			cfg.Remotes[i].Retry = &cfg.Retry
+		}
+	}
+}
+
+// Whether an error from a fetch or clone is worth retrying.
+//
+// Network problems and HTTP 5xx errors are transient.  Everything
+// else, such as a missing repo (404) or an authentication failure, is
+// permanent, as are errors from a canceled or abandoned operation.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errAbandoned) {
+		return false
+	}
+
+	// a download from a lookaside cache
+	var status_err *httpStatusError
+	if errors.As(err, &status_err) {
+		return status_err.Status >= 500
+	}
+
+	retryable, known := gogitRetryable(err)
+	if known {
+		return retryable
+	}
+	retryable, known = execRetryable(err)
+	if known {
+		return retryable
+	}
+
+	retryable, known = libgit2Retryable(err)
+	if known {
+		return retryable
+	}
+
+	// e.g. connection refused from go-git
+	var net_err net.Error
+	return errors.As(err, &net_err)
+}
+
+// Run a fetch or clone, retrying it with a growing backoff while it
+// fails with a transient error.  The wait is cut short if the context
+// is done.
+func withRetry(ctx context.Context, logger *slog.Logger, rc RetryConfig, what string, fn func() error) error {
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry >= rc.Retries || !IsRetryable(err) {
+			return err
+		}
+
+		backoff := rc.backoff(retry)
+		logger.Warn(what+" failed, retrying", "retry", retry+1, "retries", rc.Retries, "backoff", backoff, "err", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (gave up retrying: %w)", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
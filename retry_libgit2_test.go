@@ -0,0 +1,35 @@
+//go:build !nolibgit2
+
+package rgm_test
+
+import (
+	"fmt"
+	"github.com/jmahler/rgm"
+	"github.com/libgit2/git2go"
+	"testing"
+)
+
+func TestIsRetryableLibgit2(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Err       error
+		Retryable bool
+	}{
+		{"connect", &git.GitError{Message: "failed to connect to git.centos.org", Class: git.ErrorClassNet, Code: git.ErrorCodeGeneric}, true},
+		{"ssh", &git.GitError{Message: "Failed to retrieve list of SSH authentication methods", Class: git.ErrorClassSSH, Code: git.ErrorCodeGeneric}, true},
+		{"502", &git.GitError{Message: "unexpected http status code: 502", Class: git.ErrorClassNet, Code: git.ErrorCodeGeneric}, true},
+		{"503 wrapped", fmt.Errorf("fetch: %w", &git.GitError{Message: "unexpected http status code: 503", Class: git.ErrorClassNet, Code: git.ErrorCodeGeneric}), true},
+		{"404", &git.GitError{Message: "unexpected http status code: 404", Class: git.ErrorClassNet, Code: git.ErrorCodeGeneric}, false},
+		{"auth", &git.GitError{Message: "authentication required", Class: git.ErrorClassNet, Code: git.ErrorCodeAuth}, false},
+		{"not found", &git.GitError{Message: "failed to resolve path", Class: git.ErrorClassOS, Code: git.ErrorCodeNotFound}, false},
+		{"user abort", &git.GitError{Message: "callback returned", Class: git.ErrorClassCallback, Code: git.ErrorCodeUser}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if rgm.IsRetryable(c.Err) != c.Retryable {
+				t.Errorf("expected retryable %v for: %v", c.Retryable, c.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package rgm_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Err       error
+		Retryable bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("something failed"), false},
+		{"canceled", context.Canceled, false},
+		{"go-git auth", transport.ErrAuthenticationRequired, false},
+		{"go-git not found", fmt.Errorf("fetch: %w", transport.ErrRepositoryNotFound), false},
+		{"go-git 503", githttp.NewErr(gitResponse(503)), true},
+		{"go-git 400", githttp.NewErr(gitResponse(400)), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if rgm.IsRetryable(c.Err) != c.Retryable {
+				t.Errorf("expected retryable %v for: %v", c.Retryable, c.Err)
+			}
+		})
+	}
+}
+
+// A response to a request of a go-git remote.
+func gitResponse(code int) *http.Response {
+	req, _ := http.NewRequest("GET", "http://git.centos.org/rpms/patch.git/info/refs", nil)
+	return &http.Response{StatusCode: code, Request: req}
+}
+
+// Serve the testdata repos over http with `git http-backend`.
+func gitBackend(t *testing.T) http.Handler {
+	t.Helper()
+
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git_path, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &cgi.Handler{
+		Path: git_path,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+}
+
+// Serve the testdata repos over http, failing the first requests
+// with the given status.
+func flakyServer(t *testing.T, status int, failures int) (*httptest.Server, *int) {
+	t.Helper()
+
+	backend := gitBackend(t)
+
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		fail := requests <= failures
+		mu.Unlock()
+
+		if fail {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+
+	return server, &requests
+}
+
+func TestRpmMirrorRetry(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Status   int
+		Failures int
+		Requests int // expected requests that failed
+		Fetched  bool
+	}{
+		{"transient", http.StatusBadGateway, 2, 2, true},
+		{"permanent", http.StatusNotFound, 100, 1, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rgm")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			server, requests := flakyServer(t, c.Status, c.Failures)
+			defer server.Close()
+
+			cfg := rgm.Config{
+				Origin: rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+				Remotes: []rgm.RemoteConfig{
+					{Name: "fedora", URL: server.URL + "/{{.RPM}}.fedora"},
+					{Name: "centos", URL: "testdata/{{.RPM}}.centos"},
+				},
+				Retry: rgm.RetryConfig{Retries: 3, Backoff: rgm.Duration(10 * time.Millisecond)},
+			}
+
+			_, err = rgm.RpmMirrorConfig(cfg, "patch", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Fetched && *requests <= c.Requests {
+				t.Errorf("fedora wasn't retried, %d requests", *requests)
+			} else if !c.Fetched && *requests != c.Requests {
+				t.Errorf("a permanent error shouldn't be retried, %d requests", *requests)
+			}
+
+			testRefExists(t, dir, "refs/heads/fedora/f31", c.Fetched)
+			testRefExists(t, dir, "refs/heads/centos/c7", true)
+		})
+	}
+}
+
+// A retry that is cut short by the context should still tell that
+// the context is done.
+func TestRpmMirrorRetryCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rgm")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, _ := flakyServer(t, http.StatusBadGateway, 100)
+	defer server.Close()
+
+	cfg := rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin", URL: server.URL + "/{{.RPM}}.origin"},
+		Retry:  rgm.RetryConfig{Retries: 3, Backoff: rgm.Duration(time.Hour)},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = rgm.RpmMirrorConfigContext(ctx, cfg, "patch", dir)
+	if err == nil {
+		t.Fatalf("expected the clone to fail")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline in the error: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmahler/rgm"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Result of mirroring one RPM in a batch.
+type batchResult struct {
+	Rpm      string
+	Path     string
+	Err      error
+	Duration time.Duration
+	Report   *rgm.Report
+}
+
+// Read the RPM names from a package list, one per line.
+// Blank lines and lines starting with '#' are skipped, and so are
+// RPMs that were already listed.  A name is also the directory of its
+// mirror, so one that isn't a plain file name (e.g. "../patch") is an
+// error.
+//
+//	# base packages
+//	patch
+//	cowsay
+func readRpmList(r io.Reader) ([]string, error) {
+	var rpms []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, "/\\ \t") || line == "." || line == ".." {
+			return nil, fmt.Errorf("line %d of the package list: '%s' isn't a package name", n, line)
+		}
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		rpms = append(rpms, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read package list: %v", err)
+	}
+
+	return rpms, nil
+}
+
+// Open the package list, "-" is stdin.
+func openRpmList(list string) (io.ReadCloser, error) {
+	if list == "-" {
+		return os.Stdin, nil
+	}
+
+	file, err := os.Open(list)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open package list '%s': %v", list, err)
+	}
+
+	return file, nil
+}
+
+// Mirror each RPM in to <basedir>/<rpm>.rpm using at most jobs
+// workers at a time.  A failure of one RPM doesn't stop the others,
+// every result is returned in the same order as the rpms.
+func runBatch(ctx context.Context, cfg rgm.Config, rpms []string, basedir string, jobs int, progress *progressPrinter) []batchResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	results := make([]batchResult, len(rpms))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				rpm := rpms[idx]
+				path := filepath.Join(basedir, rpm+".rpm")
+
+				start := time.Now()
+				report, err := rgm.RpmMirrorOptions(ctx, cfg, rpm, path, progress.options(rpm))
+				results[idx] = batchResult{
+					Rpm:      rpm,
+					Path:     path,
+					Err:      err,
+					Duration: time.Since(start),
+					Report:   report,
+				}
+			}
+		}()
+	}
+
+	for i := range rpms {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// Print a table of the batch results followed by the totals.
+//
+//	RPM     STATUS  TIME  ERROR
+//	patch   ok      1.2s
+//	cowsay  FAILED  0.3s  unable to fetch any remotes
+func printBatchSummary(w io.Writer, results []batchResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RPM\tSTATUS\tTIME\tERROR")
+
+	failed := 0
+	for _, res := range results {
+		status := "ok"
+		msg := ""
+		if res.Err != nil {
+			status = "FAILED"
+			msg = strings.ReplaceAll(res.Err.Error(), "\n", " ")
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", res.Rpm, status, res.Duration.Round(100*time.Millisecond), msg)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d succeeded, %d failed\n", len(results)-failed, failed)
+}
+
+// Print the reports of the batch as a JSON list, in the same
+// order as the package list.
+func printBatchJSON(w io.Writer, results []batchResult) error {
+	reports := make([]*rgm.Report, len(results))
+	for i, res := range results {
+		reports[i] = res.Report
+	}
+
+	return printJSON(w, reports)
+}
+
+// Print v as indented JSON.
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("unable to write JSON: %v", err)
+	}
+
+	return nil
+}
+
+// Mirror every RPM in the package list, print the summary (or the
+// reports as JSON) and return the number of failures.
+func batchMirror(ctx context.Context, cfg rgm.Config, list string, basedir string, jobs int, as_json bool, progress *progressPrinter) (int, error) {
+	file, err := openRpmList(list)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	rpms, err := readRpmList(file)
+	if err != nil {
+		return 0, err
+	}
+
+	results := runBatch(ctx, cfg, rpms, basedir, jobs, progress)
+	if as_json {
+		err = printBatchJSON(os.Stdout, results)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		printBatchSummary(os.Stdout, results)
+	}
+
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmahler/rgm"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// The config given with -c or, without one, the default config files
+// layered on top of each other.
+func loadConfig(config string) (rgm.Config, []rgm.ConfigSetting, error) {
+	if config != "" {
+		return rgm.LoadConfigLayers([]string{config})
+	}
+
+	return rgm.LoadDefaultConfig()
+}
+
+// The config commands, e.g.
+//
+//	rgm config check config.json
+//	rgm -c config.json config check
+//	rgm config show
+func configCommand(args []string, config string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "missing config command, expected: check, show")
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		return configCheck(os.Stdout, args[1:], config)
+	case "show":
+		return configShow(os.Stdout, config)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown config command '%s', expected: check, show\n", args[0])
+	return 2
+}
+
+// Print each problem of a config, one per line.
+func printConfigErrors(w io.Writer, label string, err error) {
+	var errs rgm.ConfigErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(w, "%s: %v\n", label, err)
+		return
+	}
+
+	for _, e := range errs {
+		if e.File == "" {
+			fmt.Fprintf(w, "%s: %v\n", label, e)
+		} else {
+			fmt.Fprintln(w, e)
+		}
+	}
+}
+
+// Load each config file (the -c one or the default ones if none
+// are given) and print every problem with it, one per line.
+//
+//	config.json: Remotes[1].Name: 'fedora' is already the name of Remotes[0]
+func configCheck(w io.Writer, files []string, config string) int {
+	if len(files) == 0 && config == "" {
+		_, _, err := rgm.LoadDefaultConfig()
+		if err != nil {
+			printConfigErrors(w, "config", err)
+			return 1
+		}
+		fmt.Fprintln(w, "config: OK")
+		return 0
+	}
+
+	if len(files) == 0 {
+		files = []string{config}
+	}
+
+	status := 0
+	for _, file := range files {
+		_, err := rgm.LoadConfig(file)
+		if err != nil {
+			printConfigErrors(w, file, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s: OK\n", file)
+	}
+
+	return status
+}
+
+// Print the settings of the config and the file each one came from.
+//
+//	Origin.Name   "origin"       /etc/rgm/config.yaml
+//	Prune         "archive"      rgm.json
+func configShow(w io.Writer, config string) int {
+	_, settings, err := loadConfig(config)
+	if err != nil {
+		printConfigErrors(os.Stderr, "config", err)
+		if settings == nil {
+			return 1
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, setting := range settings {
+		value, _ := json.Marshal(setting.Value)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", setting.Path, value, setting.Source)
+	}
+	tw.Flush()
+
+	if err != nil {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmahler/rgm"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+)
+
+const defaultLookasideAddr = ":8080"
+
+// Serve the sources cache (--sources or the SourcesCache of the config)
+// as a lookaside cache until interrupted, e.g.
+//
+//	rgm --sources=/srv/sources serve-lookaside :8080
+//
+// and point fedpkg (lookaside = http://mirror:8080/repo/pkgs) at it.
+func serveLookaside(args []string, config string, sources string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "too many arguments, expected: serve-lookaside [addr]")
+		return 2
+	}
+	addr := defaultLookasideAddr
+	if len(args) == 1 {
+		addr = args[0]
+	}
+
+	if sources == "" {
+		cfg, _, err := loadConfig(config)
+		if err != nil {
+			printConfigErrors(os.Stderr, "config", err)
+			return 1
+		}
+		sources = cfg.SourcesCache
+	}
+	if sources == "" {
+		fmt.Fprintln(os.Stderr, "no sources to serve, give them with --sources or SourcesCache in the config")
+		return 2
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "serving '%s' at http://%s%s\n", sources, listener.Addr(), rgm.LookasidePrefix)
+
+	// stop cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	server := &http.Server{Handler: rgm.LookasideHandler(sources)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	err = server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -1,25 +1,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/jmahler/rgm"
 	"github.com/pborman/getopt/v2"
 	"os"
+	"os/signal"
+	"strings"
 )
 
 func main() {
 
 	var (
-		help   bool
-		config string
-		rpm    string
-		path   string
+		help    bool
+		config  string
+		rpm     string
+		path    string
+		list    string
+		basedir string = "."
+		jobs    int    = 4
+		bare    bool
+		as_json bool
+		verbose bool
+		backend string
+		sources string
 	)
 
 	getopt.Flag(&help, 'h', "help")
-	getopt.Flag(&config, 'c', "config file (e.g. config.json)")
+	getopt.Flag(&config, 'c', "config file (e.g. config.json), instead of the default ones")
 	getopt.Flag(&rpm, 'r', "rpm name (e.g. patch)")
 	getopt.Flag(&path, 'C', "path to git repo for rpm")
+	getopt.Flag(&bare, 'B', "mirror in to a bare repo (no checkout)")
+	getopt.Flag(&as_json, 'J', "print a report of what was done as JSON")
+	getopt.Flag(&verbose, 'p', "print the progress of each remote and branch (to stderr)")
+	getopt.FlagLong(&backend, "backend", 0, "git backend: "+strings.Join(rgm.Backends(), ", "), "name")
+	getopt.FlagLong(&sources, "sources", 0, "cache of the lookaside sources of the branches, to download in to or serve", "dir")
+	getopt.Flag(&list, 'b', "batch mode, file with rpm names, one per line (- for stdin)")
+	getopt.Flag(&basedir, 'd', "batch mode, directory for the <rpm>.rpm repos")
+	getopt.Flag(&jobs, 'j', "batch mode, number of rpms to mirror at once")
+	getopt.SetParameters("[config check [file ...] | config show | serve-lookaside [addr] | versions]")
 	getopt.Parse()
 
 	if help {
@@ -27,7 +47,68 @@ func main() {
 		os.Exit(0)
 	}
 
-	err := rgm.RpmMirror(config, rpm, path)
+	args := getopt.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			os.Exit(configCommand(args[1:], config))
+		case "serve-lookaside":
+			os.Exit(serveLookaside(args[1:], config, sources))
+		case "versions":
+			// needs the config, below
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command '%s'\n", args[0])
+			os.Exit(2)
+		}
+	}
+
+	cfg, _, err := loadConfig(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if bare {
+		cfg.Bare = true
+	}
+	if backend != "" {
+		cfg.Backend = backend
+	}
+	if sources != "" {
+		cfg.SourcesCache = sources
+	}
+
+	if len(args) > 0 {
+		os.Exit(versionsCommand(os.Stdout, args[1:], cfg, rpm, path, as_json))
+	}
+
+	// stop cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var progress *progressPrinter
+	if verbose {
+		progress = newProgressPrinter(os.Stderr)
+	}
+
+	if list != "" {
+		failed, err := batchMirror(ctx, cfg, list, basedir, jobs, as_json, progress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	report, err := rgm.RpmMirrorOptions(ctx, cfg, rpm, path, progress.options(rpm))
+	if as_json {
+		// the report also covers a failed run
+		if err := printJSON(os.Stdout, report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -1,7 +1,16 @@
 package main_test
 
 import (
+	"bufio"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -17,3 +26,304 @@ func TestHelp(t *testing.T) {
 		t.Errorf("unexpected help (-h) output")
 	}
 }
+
+func TestBatch(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "rgm-main_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(basedir)
+
+	// the testdata config uses paths relative to the top dir
+	cmd := exec.Command("rgm", "-c", "testdata/config.json", "-b", "-", "-d", basedir, "-j", "2")
+	cmd.Dir = ".."
+	cmd.Stdin = strings.NewReader("# packages\npatch\n\nbadrpmXXX\npatch\n")
+	out_bytes, err := cmd.Output()
+	out := string(out_bytes)
+
+	// one of the rpms doesn't exist so it should exit with an error
+	if err == nil {
+		t.Errorf("batch with a bad rpm should've failed: %s", out)
+	}
+
+	if !strings.Contains(out, "1 succeeded, 1 failed") {
+		t.Errorf("unexpected batch summary: %s", out)
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "patch" && fields[1] != "ok" {
+			t.Errorf("expected patch to be ok: '%s'", line)
+		}
+		if fields[0] == "badrpmXXX" && fields[1] != "FAILED" {
+			t.Errorf("expected badrpmXXX to fail: '%s'", line)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(basedir, "patch.rpm", ".git"))
+	if err != nil {
+		t.Errorf("patch wasn't mirrored: %v", err)
+	}
+
+	// a name that isn't a plain file name would be mirrored outside
+	// of the basedir
+	cmd = exec.Command("rgm", "-c", "testdata/config.json", "-b", "-", "-d", basedir)
+	cmd.Dir = ".."
+	cmd.Stdin = strings.NewReader("patch\n../patch\n")
+	out_bytes, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out_bytes), "'../patch' isn't a package name") {
+		t.Errorf("batch with a bad name should've failed: %s", out_bytes)
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	path, err := ioutil.TempDir("", "rgm-main_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	cmd := exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path, "-J")
+	cmd.Dir = ".."
+	out_bytes, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unable to mirror RPM: %v", err)
+	}
+
+	var report rgm.Report
+	err = json.Unmarshal(out_bytes, &report)
+	if err != nil {
+		t.Fatalf("unable to parse the JSON report: %v: %s", err, out_bytes)
+	}
+	if report.Rpm != "patch" || !report.Cloned || len(report.Branches) == 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	path, err := ioutil.TempDir("", "rgm-main_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	var stderr strings.Builder
+	cmd := exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path, "-p")
+	cmd.Dir = ".."
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("unable to mirror RPM: %v: %s", err, stderr.String())
+	}
+
+	// go-git doesn't report the fetch progress
+	out := stderr.String()
+	if rgm.DefaultBackend() != "go-git" && !strings.Contains(out, "patch fedora: ") {
+		t.Errorf("expected the fetch progress in: %s", out)
+	}
+	if !strings.Contains(out, "patch fedora/f31: created") {
+		t.Errorf("unexpected progress output: %s", out)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	for _, backend := range rgm.Backends() {
+		t.Run(backend, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "rgm-main_test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(path)
+
+			cmd := exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path, "--backend="+backend)
+			cmd.Dir = ".."
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("unable to mirror RPM: %v: %s", err, out)
+			}
+
+			out, err = exec.Command("git", "-C", path, "rev-parse", "--verify", "refs/heads/fedora/f31").CombinedOutput()
+			if err != nil {
+				t.Errorf("fedora/f31 wasn't mirrored: %v: %s", err, out)
+			}
+		})
+	}
+
+	cmd := exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", t.TempDir(), "--backend=cvs")
+	cmd.Dir = ".."
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "unknown backend") {
+		t.Errorf("an unknown backend should fail: %v: %s", err, out)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	cmd := exec.Command("rgm", "config", "check", "testdata/config.json", "testdata/config_invalid.json")
+	cmd.Dir = ".."
+	out_bytes, err := cmd.Output()
+	out := string(out_bytes)
+
+	// one of the configs is invalid so it should exit with an error
+	if err == nil {
+		t.Errorf("check of an invalid config should've failed: %s", out)
+	}
+
+	for _, line := range []string{
+		"testdata/config.json: OK",
+		"testdata/config_invalid.json: Remotes[1].Name: 'fedora' is already the name of Remotes[0]",
+		"testdata/config_invalid.json: Remotes[3].Name: 'centos/c7' contains a '/'",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected '%s' in: %s", line, out)
+		}
+	}
+
+	cmd = exec.Command("rgm", "-c", "testdata/config.json", "config", "check")
+	cmd.Dir = ".."
+	out_bytes, err = cmd.Output()
+	if err != nil || string(out_bytes) != "testdata/config.json: OK\n" {
+		t.Errorf("check of the -c config failed: %v: %s", err, out_bytes)
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	home := t.TempDir()
+	err := os.MkdirAll(filepath.Join(home, "rgm"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user_config := filepath.Join(home, "rgm", "config.yaml")
+	err = ioutil.WriteFile(user_config, []byte("Prune: archive\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("rgm", "config", "show")
+	cmd.Dir = ".."
+	cmd.Env = append(os.Environ(), "XDG_CONFIG_HOME="+home, "RGM_CONFIG=testdata/config.json")
+	out_bytes, err := cmd.Output()
+	out := string(out_bytes)
+	if err != nil {
+		t.Fatalf("config show failed: %v: %s", err, out)
+	}
+
+	for _, fields := range [][]string{
+		{"Origin.Name", `"origin"`, "testdata/config.json"},
+		{"Remotes[0].Name", `"fedora"`, "testdata/config.json"},
+		{"Prune", `"archive"`, user_config},
+	} {
+		found := false
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Join(strings.Fields(line), " ") == strings.Join(fields, " ") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected '%s' in: %s", strings.Join(fields, " "), out)
+		}
+	}
+}
+
+func TestServeLookaside(t *testing.T) {
+	cache := t.TempDir()
+	data := "the patch tarball"
+	sum := sha512.Sum512([]byte(data))
+	src := rgm.Source{Filename: "patch-2.7.6.tar.xz", HashType: "sha512", Hash: hex.EncodeToString(sum[:])}
+	err := os.MkdirAll(filepath.Dir(src.CachePath(cache)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(src.CachePath(cache), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("rgm", "--sources="+cache, "serve-lookaside", "127.0.0.1:0")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("unable to start serve-lookaside: %v", err)
+	}
+	defer func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	}()
+
+	// serving '<cache>' at http://127.0.0.1:<port>/repo/pkgs/
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no address from serve-lookaside: %v", err)
+	}
+	base := strings.TrimSpace(line[strings.Index(line, "http://"):])
+
+	missing := strings.Repeat("0", 128)
+	for file, status := range map[string]int{
+		"patch/patch-2.7.6.tar.xz/sha512/" + src.Hash + "/patch-2.7.6.tar.xz": http.StatusOK,
+		"patch/patch-2.7.6.tar.xz/sha512/" + missing + "/patch-2.7.6.tar.xz":  http.StatusNotFound,
+	} {
+		resp, err := http.Get(base + file)
+		if err != nil {
+			t.Fatalf("unable to get '%s': %v", file, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("expected %d for '%s', got %d", status, file, resp.StatusCode)
+		} else if status == http.StatusOK && string(body) != data {
+			t.Errorf("unexpected '%s': %q", file, body)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	path := t.TempDir()
+
+	cmd := exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path)
+	cmd.Dir = ".."
+	out_bytes, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to mirror RPM: %v: %s", err, out_bytes)
+	}
+
+	// the rpm has to be named
+	cmd = exec.Command("rgm", "-c", "testdata/config.json", "-C", path, "versions")
+	cmd.Dir = ".."
+	out_bytes, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out_bytes), "-r") {
+		t.Errorf("versions without -r should've failed: %s", out_bytes)
+	}
+
+	// the test repos don't have a spec
+	cmd = exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path, "versions")
+	cmd.Dir = ".."
+	out_bytes, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("versions failed: %v", err)
+	}
+	lines := strings.Split(string(out_bytes), "\n")
+	if strings.Join(strings.Fields(lines[0]), " ") != "BRANCH NAME EPOCH VERSION RELEASE" {
+		t.Errorf("unexpected header: %s", out_bytes)
+	}
+	if !strings.Contains(string(out_bytes), "fedora/f31") || !strings.Contains(string(out_bytes), "no spec") {
+		t.Errorf("expected fedora/f31 without a spec in: %s", out_bytes)
+	}
+
+	cmd = exec.Command("rgm", "-c", "testdata/config.json", "-r", "patch", "-C", path, "-J", "versions")
+	cmd.Dir = ".."
+	out_bytes, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("versions -J failed: %v", err)
+	}
+	var specs []rgm.BranchSpec
+	err = json.Unmarshal(out_bytes, &specs)
+	if err != nil || len(specs) == 0 || specs[0].Error != "no spec" {
+		t.Errorf("unexpected JSON versions: %v: %s", err, out_bytes)
+	}
+}
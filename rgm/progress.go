@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmahler/rgm"
+	"io"
+	"sync"
+	"time"
+)
+
+// Prints a progress line for each remote as it is fetched and one
+// for each branch that is updated.  Each line starts with the RPM so
+// the lines of a batch can be told apart.
+//
+//	patch fedora: 120/310 objects, 96/310 indexed, 1.2 MiB
+//	patch fedora: 310/310 objects, 310/310 indexed, 2.9 MiB, done
+//	patch fedora/f31: fast-forwarded 3d1f0a2c..8b7e5d11
+type progressPrinter struct {
+	w        io.Writer
+	interval time.Duration
+	mu       sync.Mutex
+	last     map[string]time.Time
+	done     map[string]bool
+}
+
+func newProgressPrinter(w io.Writer) *progressPrinter {
+	return &progressPrinter{
+		w:        w,
+		interval: 500 * time.Millisecond,
+		last:     make(map[string]time.Time),
+		done:     make(map[string]bool),
+	}
+}
+
+// Human readable size, e.g. 1.2 MiB.
+func formatBytes(n uint) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// Print the progress of a remote, at most once per interval except
+// for the last line which is always printed (once).
+func (p *progressPrinter) fetchProgress(rpm string, prog rgm.FetchProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := rpm + " " + prog.Remote
+	if p.done[key] {
+		return
+	}
+	now := time.Now()
+	if !prog.Done() && now.Sub(p.last[key]) < p.interval {
+		return
+	}
+	p.last[key] = now
+
+	done := ""
+	if prog.Done() {
+		done = ", done"
+		p.done[key] = true
+	}
+
+	fmt.Fprintf(p.w, "%s %s: %d/%d objects, %d/%d indexed, %s%s\n", rpm, prog.Remote,
+		prog.ReceivedObjects, prog.TotalObjects, prog.IndexedObjects, prog.TotalObjects,
+		formatBytes(prog.ReceivedBytes), done)
+}
+
+func (p *progressPrinter) branchUpdate(rpm string, br rgm.BranchReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msg := string(br.Status)
+	short := func(oid string) string {
+		if len(oid) > 8 {
+			return oid[:8]
+		}
+		return oid
+	}
+	switch {
+	case br.Error != "":
+		msg += ", " + br.Error
+	case br.OldOid != "" && br.NewOid != "":
+		msg += " " + short(br.OldOid) + ".." + short(br.NewOid)
+	case br.NewOid != "":
+		msg += " " + short(br.NewOid)
+	}
+
+	fmt.Fprintf(p.w, "%s %s: %s\n", rpm, br.Name, msg)
+}
+
+// The options to mirror an RPM with, no progress is printed if p is
+// nil.
+func (p *progressPrinter) options(rpm string) rgm.Options {
+	if p == nil {
+		return rgm.Options{}
+	}
+
+	return rgm.Options{
+		FetchProgress: func(prog rgm.FetchProgress) {
+			p.fetchProgress(rpm, prog)
+		},
+		BranchUpdate: func(br rgm.BranchReport) {
+			p.branchUpdate(rpm, br)
+		},
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jmahler/rgm"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// Print the version of the spec on each branch of a mirror, or with
+// -J all of what was parsed from them.  The mirror is named with -r
+// like for a run, its spec is <rpm>.spec.
+//
+//	BRANCH      NAME   EPOCH  VERSION  RELEASE
+//	centos/c7   patch         2.7.1    12
+//	fedora/f31  patch         2.7.6    11
+//	fedora/f29  -                      no spec
+func versionsCommand(w io.Writer, args []string, cfg rgm.Config, rpm string, path string, as_json bool) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "too many arguments, expected: versions")
+		return 2
+	}
+	if rpm == "" {
+		fmt.Fprintln(os.Stderr, "no rpm name, give it with -r")
+		return 2
+	}
+
+	m, err := rgm.NewMirror(cfg, rpm, path, rgm.Options{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer m.Close()
+
+	err = m.Open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	specs, err := m.Specs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if as_json {
+		err = printJSON(w, specs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BRANCH\tNAME\tEPOCH\tVERSION\tRELEASE")
+	for _, bs := range specs {
+		if bs.Spec == nil {
+			fmt.Fprintf(tw, "%s\t-\t\t\t%s\n", bs.Branch, bs.Error)
+			continue
+		}
+		s := bs.Spec
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", bs.Branch, s.Name, s.Epoch, s.Version, s.Release)
+	}
+	tw.Flush()
+
+	return 0
+}
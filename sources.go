@@ -0,0 +1,274 @@
+package rgm
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A source (e.g. a tarball) of a dist-git branch, a line of its
+// sources file.  Only the hash is in git, the source itself is in the
+// lookaside cache of the remote.
+type Source struct {
+	Filename string
+	HashType string // md5, sha1, sha256 or sha512
+	Hash     string
+}
+
+// The lines of a sources file, with the type of the hash
+//
+//	SHA512 (patch-2.7.6.tar.xz) = fcca87bdb67a88685a8a25597f9e015f...
+//
+// or in the old format, where it is always md5.
+//
+//	4c68cee989d83c87b00a3860bcd05600  patch-2.7.6.tar.xz
+var (
+	sourcesLineRe    = regexp.MustCompile(`^([A-Za-z0-9]+) \((.+)\) = ([0-9A-Fa-f]+)$`)
+	sourcesOldLineRe = regexp.MustCompile(`^([0-9A-Fa-f]{32})\s+(\S.*)$`)
+)
+
+var sourceHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Parse a dist-git sources file, in either format.
+func ParseSources(data []byte) ([]Source, error) {
+	var sources []Source
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var src Source
+		if match := sourcesLineRe.FindStringSubmatch(line); match != nil {
+			src = Source{Filename: match[2], HashType: strings.ToLower(match[1]), Hash: strings.ToLower(match[3])}
+		} else if match := sourcesOldLineRe.FindStringSubmatch(line); match != nil {
+			src = Source{Filename: match[2], HashType: "md5", Hash: strings.ToLower(match[1])}
+		} else {
+			return nil, fmt.Errorf("line %d: unknown format '%s'", i+1, line)
+		}
+
+		err := src.check()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// Check that the hash of a source is one we know and that its file
+// name is safe to use in a URL.
+func (src Source) check() error {
+	new_hash, ok := sourceHashes[src.HashType]
+	if !ok {
+		return fmt.Errorf("unknown hash '%s'", src.HashType)
+	}
+	if _, err := hex.DecodeString(src.Hash); err != nil || len(src.Hash) != 2*new_hash().Size() {
+		return fmt.Errorf("'%s' isn't a %s hash", src.Hash, src.HashType)
+	}
+	if src.Filename == "" || strings.Contains(src.Filename, "/") || src.Filename == "." || src.Filename == ".." {
+		return fmt.Errorf("bad file name '%s'", src.Filename)
+	}
+
+	return nil
+}
+
+// Where a source is kept in a cache, which is by its hash so that
+// the same source is only downloaded once for every branch and RPM.
+//
+//	<cache>/sha512/fcca87bdb67a88685a8a25597f9e015f...
+func (src Source) CachePath(cache string) string {
+	return filepath.Join(cache, src.HashType, src.Hash)
+}
+
+// An HTTP request that didn't get a 200 OK.
+type httpStatusError struct {
+	URL    string
+	Status int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET '%s' failed: %d %s", e.URL, e.Status, http.StatusText(e.Status))
+}
+
+// Download a source in to the cache, checking its hash on the way.
+// It is written to a temp file first so that another mirror using
+// the same cache never sees a partial (or bad) one.
+func downloadSource(ctx context.Context, url string, src Source, cache string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{URL: url, Status: resp.StatusCode}
+	}
+
+	path := src.CachePath(cache)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // once it is renamed there is nothing to remove
+
+	h := sourceHashes[src.HashType]()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return fmt.Errorf("GET '%s' failed: %v", url, err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != src.Hash {
+		return fmt.Errorf("%s of '%s' from '%s' is %s, expected %s", src.HashType, src.Filename, url, sum, src.Hash)
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get a source of a branch in to the cache, unless it is already
+// there.  It is downloaded from the Lookaside of the remote, giving up
+// after its Timeout (if any) and retrying transient failures.
+func fetchSource(ctx context.Context, rc *RemoteConfig, rpm string, bm branchMapping, src Source, cache string, run *mirrorRun) (SourceStatus, error) {
+	_, err := os.Stat(src.CachePath(cache))
+	if err == nil {
+		return SourceCached, nil
+	}
+	if !os.IsNotExist(err) {
+		return SourceFailed, err
+	}
+
+	data := rc.templateData(rpm)
+	data.Branch = bm.branch
+	data.Filename = src.Filename
+	data.Hash = src.Hash
+	data.HashType = src.HashType
+	url, err := execTemplate(rc.Lookaside, data)
+	if err != nil {
+		return SourceFailed, err
+	}
+
+	download := func() error {
+		ctx := ctx
+		if rc.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(rc.Timeout))
+			defer cancel()
+		}
+		return downloadSource(ctx, url, src, cache)
+	}
+	err = withRetry(ctx, run.logger(), rc.retryConfig(), fmt.Sprintf("download of '%s'", url), download)
+	if err != nil {
+		return SourceFailed, err
+	}
+
+	return SourceDownloaded, nil
+}
+
+// Download the sources of each local branch that are missing from
+// the cache, see Mirror.Sources.
+func downloadSources(ctx context.Context, repo repository, rcs []RemoteConfig, rpm string, cache string, run *mirrorRun) error {
+	settings := make(map[string]*RemoteConfig)
+	for i := range rcs {
+		settings[rcs[i].Name] = &rcs[i]
+	}
+
+	branches, err := getExpectedLocalBranches(repo, rcs)
+	if err != nil {
+		return fmt.Errorf("unable to get branches: %v", err)
+	}
+
+	var failed []string
+	fail := func(sr *SourceReport, err error) {
+		run.logger().Warn("unable to get source", "branch", sr.Branch, "file", sr.Filename, "err", err)
+		failed = append(failed, err.Error())
+		sr.Status = SourceFailed
+		sr.Error = err.Error()
+	}
+
+	for _, bm := range branches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rc, ok := settings[bm.remote]
+		if !ok || rc.Lookaside == "" {
+			continue
+		}
+
+		// a branch that couldn't be created has nothing to get
+		commit, err := repo.BranchTarget(bm.local, localBranch)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to lookup branch '%s': %v", bm.local, err)
+		}
+
+		data, err := repo.ReadFile(commit, "sources")
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read the sources of '%s': %v", bm.local, err)
+		}
+		sources, err := ParseSources(data)
+		if err != nil {
+			fail(run.source(bm.local, Source{Filename: "sources"}), fmt.Errorf("sources of '%s': %v", bm.local, err))
+			continue
+		}
+
+		for _, src := range sources {
+			sr := run.source(bm.local, src)
+			status, err := fetchSource(ctx, rc, rpm, bm, src, cache, run)
+			if err != nil {
+				fail(sr, err)
+				continue
+			}
+			sr.Status = status
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to get %d source(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
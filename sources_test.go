@@ -0,0 +1,202 @@
+package rgm_test
+
+import (
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/jmahler/rgm"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSources(t *testing.T) {
+	sha := strings.Repeat("ab", 64)
+	md := strings.Repeat("cd", 16)
+
+	cases := []struct {
+		Data    string
+		Sources []rgm.Source
+		Error   string
+	}{
+		{"SHA512 (patch-2.7.6.tar.xz) = " + sha + "\n", []rgm.Source{{"patch-2.7.6.tar.xz", "sha512", sha}}, ""},
+		{md + "  patch-2.7.6.tar.xz\n", []rgm.Source{{"patch-2.7.6.tar.xz", "md5", md}}, ""},
+		{"\nSHA512 (a b.tar.gz) = " + strings.ToUpper(sha) + "\n\n" + md + "  b.sig\n", []rgm.Source{{"a b.tar.gz", "sha512", sha}, {"b.sig", "md5", md}}, ""},
+		{"", nil, ""},
+		{"patch-2.7.6.tar.xz\n", nil, "line 1: unknown format"},
+		{"\nSHA3 (patch-2.7.6.tar.xz) = " + sha + "\n", nil, "line 2: unknown hash 'sha3'"},
+		{"SHA512 (patch-2.7.6.tar.xz) = " + md + "\n", nil, "isn't a sha512 hash"},
+		{"SHA512 (../patch-2.7.6.tar.xz) = " + sha + "\n", nil, "bad file name"},
+	}
+
+	for _, c := range cases {
+		sources, err := rgm.ParseSources([]byte(c.Data))
+		if c.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), c.Error) {
+				t.Errorf("expected error '%s' for %q, got: %v", c.Error, c.Data, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unable to parse %q: %v", c.Data, err)
+			continue
+		}
+		if !reflect.DeepEqual(sources, c.Sources) {
+			t.Errorf("expected %v for %q, got %v", c.Sources, c.Data, sources)
+		}
+	}
+}
+
+// Add a commit with a file on top of a branch in a (bare) repo, like
+// a push would.
+func pushFile(t *testing.T, dir string, branch string, name string, data string) {
+	t.Helper()
+
+	env := append(os.Environ(),
+		"GIT_INDEX_FILE="+filepath.Join(t.TempDir(), "index"),
+		"GIT_AUTHOR_NAME=rgm", "GIT_AUTHOR_EMAIL=rgm@example.com",
+		"GIT_COMMITTER_NAME=rgm", "GIT_COMMITTER_EMAIL=rgm@example.com")
+	git := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(stdin)
+		out_bytes, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("unable to git %v in '%s': %v", args, dir, err)
+		}
+		return strings.TrimSpace(string(out_bytes))
+	}
+
+	blob := git(data, "hash-object", "-w", "--stdin")
+	git("", "read-tree", branch)
+	git("", "update-index", "--add", "--cacheinfo", "100644,"+blob+","+name)
+	tree := git("", "write-tree")
+	commit := git("", "commit-tree", "-p", branch, "-m", "add "+name, tree)
+	git("", "update-ref", "refs/heads/"+branch, commit)
+}
+
+func sha512Hex(data string) string {
+	sum := sha512.Sum512([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRpmMirrorSources(t *testing.T) {
+	dir := t.TempDir()
+
+	// a lookaside cache, by file name
+	files := map[string]string{
+		"patch-2.7.6.tar.xz": "the patch tarball",
+		"patch.sig":          "a signature",
+		"bad.tar.xz":         "not what the hash says",
+	}
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+
+		data, ok := files[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	rpm := "patch"
+	cache := filepath.Join(dir, "sources")
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora", Lookaside: server.URL + "/pkgs/{{.Name}}/{{.Filename}}/{{.HashType}}/{{.Hash}}/{{.Filename}}"},
+			{Name: "centos"},
+		},
+		SourcesCache: cache,
+	})
+	path := filepath.Join(dir, "mirror")
+
+	tarball := rgm.Source{Filename: "patch-2.7.6.tar.xz", HashType: "sha512", Hash: sha512Hex(files["patch-2.7.6.tar.xz"])}
+	sig := rgm.Source{Filename: "patch.sig", HashType: "md5", Hash: md5Hex(files["patch.sig"])}
+	upstream := filepath.Join(dir, rpm+".fedora")
+	pushFile(t, upstream, "f31", "sources", "SHA512 (patch-2.7.6.tar.xz) = "+tarball.Hash+"\n")
+	pushFile(t, upstream, "f30", "sources", sig.Hash+"  patch.sig\n")
+
+	report, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []rgm.Source{tarball, sig} {
+		data, err := ioutil.ReadFile(src.CachePath(cache))
+		if err != nil {
+			t.Errorf("source '%s' wasn't downloaded: %v", src.Filename, err)
+		} else if string(data) != files[src.Filename] {
+			t.Errorf("unexpected '%s': %q", src.Filename, data)
+		}
+	}
+	expected := []rgm.SourceReport{
+		{Branch: "fedora/f30", Filename: "patch.sig", HashType: "md5", Hash: sig.Hash, Status: rgm.SourceDownloaded},
+		{Branch: "fedora/f31", Filename: "patch-2.7.6.tar.xz", HashType: "sha512", Hash: tarball.Hash, Status: rgm.SourceDownloaded},
+	}
+	if !reflect.DeepEqual(report.Sources, expected) {
+		t.Errorf("expected sources %+v, got %+v", expected, report.Sources)
+	}
+	want := "/pkgs/patch/patch-2.7.6.tar.xz/sha512/" + tarball.Hash + "/patch-2.7.6.tar.xz"
+	if len(requests) != 2 || requests[1] != want {
+		t.Errorf("expected a request for '%s', got %v", want, requests)
+	}
+
+	// what is cached isn't downloaded again, a bad download isn't kept
+	bad := rgm.Source{Filename: "bad.tar.xz", HashType: "sha512", Hash: sha512Hex("the real tarball")}
+	pushFile(t, upstream, "f29", "sources", "SHA512 (bad.tar.xz) = "+bad.Hash+"\n")
+	requests = nil
+
+	report, err = rgm.RpmMirror(config, rpm, path)
+	if err == nil || !strings.Contains(err.Error(), "unable to get 1 source(s)") {
+		t.Errorf("expected the bad source to fail, got: %v", err)
+	}
+
+	if len(requests) != 1 {
+		t.Errorf("expected only the bad source to be requested, got %v", requests)
+	}
+	for _, sr := range report.Sources {
+		status := rgm.SourceCached
+		if sr.Filename == "bad.tar.xz" {
+			status = rgm.SourceFailed
+		}
+		if sr.Status != status {
+			t.Errorf("expected '%s' of '%s' to be %s, got %s (%s)", sr.Filename, sr.Branch, status, sr.Status, sr.Error)
+		}
+	}
+	if len(report.Sources) != 3 {
+		t.Errorf("expected 3 sources, got %+v", report.Sources)
+	}
+	if _, err := os.Stat(bad.CachePath(cache)); !os.IsNotExist(err) {
+		t.Errorf("expected no bad source in the cache: %v", err)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Dir(bad.CachePath(cache)))
+	if len(entries) != 1 {
+		t.Errorf("expected only the tarball in the cache, got %d files", len(entries))
+	}
+
+	// the branches were still updated
+	testRefExists(t, path, "refs/heads/fedora/f29", true)
+	if revParse(t, path, "fedora/f29") != revParse(t, upstream, "f29") {
+		t.Errorf("expected fedora/f29 to be updated")
+	}
+}
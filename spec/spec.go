@@ -0,0 +1,468 @@
+// Package spec parses the parts of an RPM spec file that tell which
+// version of a package it is: the Name, Version, Release and Epoch
+// tags, the Source and Patch lines and the %changelog.
+//
+// Macros are expanded as they are defined (%define and %global) and
+// from the tags, but it isn't rpm.  Shell (%(...)), lua, parametric
+// and built-in macros are left as they are, and a %if it can't
+// evaluate is taken as false.
+package spec
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The parts of a spec, with the macros expanded.
+type Spec struct {
+	Name      string
+	Version   string
+	Release   string
+	Epoch     string           `json:",omitempty"`
+	Sources   []File           `json:",omitempty"`
+	Patches   []File           `json:",omitempty"`
+	Changelog []ChangelogEntry `json:",omitempty"`
+}
+
+// A Source or Patch tag, an unnumbered one is 0.
+//
+//	Source0: https://ftp.gnu.org/gnu/patch/patch-%{version}.tar.xz
+type File struct {
+	Number int
+	Value  string
+}
+
+// An entry of the %changelog, they are newest first like in the spec.
+//
+//	%changelog
+//	* Mon Jan 27 2020 Jane Doe <jane@example.com> - 2.7.6-12
+//	- fix CVE-2019-13636
+type ChangelogEntry struct {
+	Date    string // Mon Jan 27 2020
+	Author  string // Jane Doe <jane@example.com>
+	Version string `json:",omitempty"` // 2.7.6-12
+	Text    []string
+}
+
+// The [epoch:]version-release of the spec.
+func (s *Spec) EVR() string {
+	evr := s.Version + "-" + s.Release
+	if s.Epoch != "" {
+		evr = s.Epoch + ":" + evr
+	}
+
+	return evr
+}
+
+// The name-[epoch:]version-release of the spec.
+func (s *Spec) NEVR() string {
+	return s.Name + "-" + s.EVR()
+}
+
+// The sections that end the preamble, where the tags are.
+var sections = map[string]bool{
+	"%description": true, "%package": true, "%prep": true, "%build": true,
+	"%install": true, "%check": true, "%clean": true, "%files": true,
+	"%changelog": true, "%pre": true, "%post": true, "%preun": true,
+	"%postun": true, "%pretrans": true, "%posttrans": true,
+	"%triggerin": true, "%triggerun": true, "%triggerpostun": true,
+	"%verifyscript": true, "%generate_buildrequires": true, "%conf": true,
+}
+
+var (
+	tagRe   = regexp.MustCompile(`^([A-Za-z]+)([0-9]*)\s*(\([^)]*\))?\s*:\s*(.*)$`)
+	nameRe  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	defRe   = regexp.MustCompile(`^%(define|global)\s+([A-Za-z_][A-Za-z0-9_]*)(\([^)]*\))?\s+(.*)$`)
+	cmpRe   = regexp.MustCompile(`^(.*?)\s*(==|!=|<=|>=|<|>)\s*(.*)$`)
+	headRe  = regexp.MustCompile(`^\*\s+(\S+\s+\S+\s+\S+\s+\S+)\s*(.*)$`)
+	emailRe = regexp.MustCompile(`^(.*>)\s*(\S*)$`)
+)
+
+// How deep macros are expanded, so that one that expands to itself
+// doesn't go on forever.
+const maxDepth = 32
+
+// How much a string can be expanded, so that macros that each expand
+// to several of the next (a billion laughs) can't take all the memory
+// and time.
+const maxLength = 1 << 20
+
+type parser struct {
+	macros map[string]string
+	// what is left of maxLength for the string being expanded
+	left int
+	// set once a string was expanded past maxLength
+	err error
+}
+
+// A %if (or %else) that is being read.
+type condition struct {
+	active bool // its lines are read
+	taken  bool // a branch of it was read
+	parent bool // the lines around it are read
+}
+
+// Parse a spec.  The macros (e.g. "dist": ".fc31") are defined before
+// it is read, the ones that aren't (%{?dist}) expand to nothing.
+func Parse(data []byte, macros map[string]string) (*Spec, error) {
+	p := &parser{macros: make(map[string]string)}
+	for name, value := range macros {
+		p.macros[name] = value
+	}
+
+	s := &Spec{}
+	section := ""
+	var conds []condition
+	active := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		if p.err != nil {
+			return nil, fmt.Errorf("line %d: %v", i, p.err)
+		}
+
+		line := strings.TrimRight(lines[i], " \t\r")
+		fields := strings.Fields(line)
+		word := ""
+		if len(fields) > 0 {
+			word = fields[0]
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), word))
+
+		switch word {
+		case "%if", "%ifarch", "%ifnarch", "%ifos", "%ifnos":
+			// there is no arch or os, so those are always read
+			parent := active()
+			ok := parent && (word != "%if" || p.condition(rest))
+			conds = append(conds, condition{active: ok, taken: ok, parent: parent})
+			continue
+		case "%elif":
+			if len(conds) > 0 {
+				c := &conds[len(conds)-1]
+				c.active = c.parent && !c.taken && p.condition(rest)
+				c.taken = c.taken || c.active
+			}
+			continue
+		case "%else":
+			if len(conds) > 0 {
+				c := &conds[len(conds)-1]
+				c.active = c.parent && !c.taken
+				c.taken = true
+			}
+			continue
+		case "%endif":
+			if len(conds) > 0 {
+				conds = conds[:len(conds)-1]
+			}
+			continue
+		}
+		if !active() {
+			continue
+		}
+
+		if sections[word] {
+			section = word
+			continue
+		}
+
+		if word == "%define" || word == "%global" {
+			// a definition can go on over several lines
+			for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+				i++
+				line = strings.TrimSuffix(line, "\\") + "\n" + strings.TrimRight(lines[i], " \t\r")
+			}
+			match := defRe.FindStringSubmatch(strings.TrimSpace(line))
+			if match == nil || match[3] != "" {
+				continue // parametric macros aren't expanded
+			}
+			value := match[4]
+			if match[1] == "global" {
+				value = p.expand(value, 0)
+			}
+			p.macros[match[2]] = value
+			continue
+		}
+
+		switch section {
+		case "":
+			err := p.tag(s, line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		case "%changelog":
+			if strings.HasPrefix(line, "*") {
+				s.Changelog = append(s.Changelog, parseChangelogHeader(line))
+			} else if line != "" && len(s.Changelog) > 0 {
+				entry := &s.Changelog[len(s.Changelog)-1]
+				entry.Text = append(entry.Text, line)
+			}
+		}
+	}
+
+	switch {
+	case p.err != nil:
+		return nil, fmt.Errorf("line %d: %v", len(lines), p.err)
+	case s.Name == "":
+		return nil, fmt.Errorf("no Name")
+	case s.Version == "":
+		return nil, fmt.Errorf("no Version")
+	case s.Release == "":
+		return nil, fmt.Errorf("no Release")
+	}
+
+	return s, nil
+}
+
+// Read a tag of the preamble, the ones that aren't needed are
+// skipped.
+func (p *parser) tag(s *Spec, line string) error {
+	match := tagRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	tag := strings.ToLower(match[1])
+	number := match[2]
+	value := p.expand(strings.TrimSpace(match[4]), 0)
+
+	fields := map[string]*string{"name": &s.Name, "version": &s.Version, "release": &s.Release, "epoch": &s.Epoch}
+	if field, ok := fields[tag]; ok && number == "" {
+		*field = value
+		p.macros[tag] = value
+		return nil
+	}
+
+	if tag != "source" && tag != "patch" {
+		return nil
+	}
+	n := 0
+	if number != "" {
+		var err error
+		n, err = strconv.Atoi(number)
+		if err != nil {
+			return fmt.Errorf("bad %s number '%s'", match[1], number)
+		}
+	}
+	p.macros[fmt.Sprintf("%s%d", strings.ToUpper(tag), n)] = value
+	if tag == "source" {
+		s.Sources = append(s.Sources, File{Number: n, Value: value})
+	} else {
+		s.Patches = append(s.Patches, File{Number: n, Value: value})
+	}
+
+	return nil
+}
+
+// The date, author and version of a changelog entry.
+//
+//	%changelog
+//	* Mon Jan 27 2020 Jane Doe <jane@example.com> - 2.7.6-12
+//	* Mon Jan 27 2020 Jane Doe <jane@example.com> 2.7.6-12
+func parseChangelogHeader(line string) ChangelogEntry {
+	match := headRe.FindStringSubmatch(line)
+	if match == nil {
+		return ChangelogEntry{Date: strings.TrimSpace(strings.TrimPrefix(line, "*"))}
+	}
+
+	entry := ChangelogEntry{Date: strings.Join(strings.Fields(match[1]), " "), Author: match[2]}
+	if i := strings.LastIndex(match[2], " - "); i >= 0 {
+		entry.Author = strings.TrimSpace(match[2][:i])
+		entry.Version = strings.TrimSpace(match[2][i+3:])
+	} else if email := emailRe.FindStringSubmatch(match[2]); email != nil {
+		entry.Author = strings.TrimSpace(email[1])
+		entry.Version = email[2]
+	}
+
+	return entry
+}
+
+// Expand the macros in a string.  The ones that aren't defined are
+// left as they are, except for %{?name}.  Every string that is
+// expanded along the way counts towards maxLength, past it p.err is
+// set and the rest expands to nothing.
+//
+//	%name  %{name}  %{?name}  %{!?name}  %{?name:value}  %{!?name:value}  %%
+func (p *parser) expand(s string, depth int) string {
+	if depth == 0 {
+		p.left = maxLength
+	}
+	p.left -= len(s)
+	if p.left < 0 {
+		if p.err == nil {
+			p.err = fmt.Errorf("macros expand to more than %d bytes", maxLength)
+		}
+		return ""
+	}
+	if depth > maxDepth || !strings.Contains(s, "%") {
+		return s
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '%':
+			out.WriteByte('%')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+1)
+			if end < 0 {
+				out.WriteString(s[i:])
+				return out.String()
+			}
+			out.WriteString(p.expandBraces(s[i+2:end], s[i:end+1], depth))
+			i = end
+		case next == '_' || next >= 'A' && next <= 'Z' || next >= 'a' && next <= 'z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			value, ok := p.macros[s[i+1:j]]
+			if ok {
+				out.WriteString(p.expand(value, depth+1))
+			} else {
+				out.WriteString(s[i:j])
+			}
+			i = j - 1
+		default:
+			out.WriteByte('%')
+		}
+	}
+
+	return out.String()
+}
+
+// The index of the } that closes the { at open, -1 if there isn't one.
+func closingBrace(s string, open int) int {
+	level := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			level++
+		case '}':
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// Expand %{body}, orig is all of it for the ones that are left as they
+// are (e.g. %{lua: ...}).
+func (p *parser) expandBraces(body string, orig string, depth int) string {
+	conditional, negate := false, false
+	switch {
+	case strings.HasPrefix(body, "!?") || strings.HasPrefix(body, "?!"):
+		conditional, negate = true, true
+		body = body[2:]
+	case strings.HasPrefix(body, "?"):
+		conditional = true
+		body = body[1:]
+	}
+
+	name, alt, has_alt := strings.Cut(body, ":")
+	if !nameRe.MatchString(name) || (has_alt && !conditional) {
+		return orig
+	}
+
+	value, defined := p.macros[name]
+	if !conditional {
+		if !defined {
+			return orig
+		}
+		return p.expand(value, depth+1)
+	}
+
+	if defined == negate {
+		return ""
+	}
+	if has_alt {
+		return p.expand(alt, depth+1)
+	}
+
+	return p.expand(value, depth+1)
+}
+
+// Evaluate the expression of a %if, only numbers and strings compared
+// with each other, joined with && and ||, can be.
+//
+//	%if 0%{?fedora} >= 31 || 0%{?rhel} > 7
+func (p *parser) condition(expr string) bool {
+	expr = p.expand(expr, 0)
+
+	for _, or := range strings.Split(expr, "||") {
+		all := true
+		for _, and := range strings.Split(or, "&&") {
+			ok, known := compare(strings.Trim(and, "() \t"))
+			if !known {
+				return false
+			}
+			all = all && ok
+		}
+		if all {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compare(expr string) (bool, bool) {
+	negate := false
+	for strings.HasPrefix(expr, "!") && !strings.HasPrefix(expr, "!=") {
+		negate = !negate
+		expr = strings.TrimSpace(expr[1:])
+	}
+
+	match := cmpRe.FindStringSubmatch(expr)
+	if match == nil {
+		n, err := strconv.Atoi(expr)
+		if err != nil {
+			return false, false
+		}
+		return (n != 0) != negate, true
+	}
+
+	a, b := strings.Trim(match[1], `"`), strings.Trim(match[3], `"`)
+	c := strings.Compare(a, b)
+	x, x_err := strconv.Atoi(a)
+	y, y_err := strconv.Atoi(b)
+	if x_err == nil && y_err == nil {
+		c = 0
+		if x < y {
+			c = -1
+		} else if x > y {
+			c = 1
+		}
+	} else if strings.ContainsRune(a+b, '%') {
+		return false, false // a macro that wasn't expanded
+	}
+
+	var ok bool
+	switch match[2] {
+	case "==":
+		ok = c == 0
+	case "!=":
+		ok = c != 0
+	case "<":
+		ok = c < 0
+	case ">":
+		ok = c > 0
+	case "<=":
+		ok = c <= 0
+	case ">=":
+		ok = c >= 0
+	}
+
+	return ok != negate, true
+}
@@ -0,0 +1,153 @@
+package spec_test
+
+import (
+	"fmt"
+	"github.com/jmahler/rgm/spec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const patchSpec = `%global major 2.7
+%define minor 6
+%if 0%{?fedora} >= 31 || 0%{?rhel} > 8
+%global with_selinux 1
+%else
+%global with_selinux 0
+%endif
+
+Summary: Utility for modifying/upgrading files
+Name: patch
+Epoch: 1
+Version: %{major}.%minor
+%if %{with_selinux}
+Release: 12%{?dist}
+%else
+Release: 11%{?dist}
+%endif
+License: GPLv3+
+URL: https://www.gnu.org/software/patch/patch.html
+Source: https://ftp.gnu.org/gnu/patch/patch-%{version}.tar.xz
+Source1: %{SOURCE0}.sig
+Patch1: patch-2.7.6-avoid-set_file_attributes-sign-conversion-warnings.patch
+Patch2: %{name}-%{?!fedora:el}%{?fedora:fc}.patch
+%if %{with python3}
+Patch3: not-read.patch
+%endif
+%ifarch x86_64
+Patch4: %{lua: print("left as is")}
+%endif
+
+%description
+Name: not-the-name
+
+%prep
+%autosetup -p1
+
+%changelog
+* Mon Jan 27 2020 Jane Doe <jane@example.com> - 1:2.7.6-12
+- fix CVE-2019-13636
+- fix CVE-2019-13638
+
+* Tue Jul 30 2019 John Doe <john@example.com> 1:2.7.6-11
+- Rebuilt for %%dist
+`
+
+func TestParse(t *testing.T) {
+	s, err := spec.Parse([]byte(patchSpec), map[string]string{"fedora": "31", "dist": ".fc31"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &spec.Spec{
+		Name:    "patch",
+		Version: "2.7.6",
+		Release: "12.fc31",
+		Epoch:   "1",
+		Sources: []spec.File{
+			{0, "https://ftp.gnu.org/gnu/patch/patch-2.7.6.tar.xz"},
+			{1, "https://ftp.gnu.org/gnu/patch/patch-2.7.6.tar.xz.sig"},
+		},
+		Patches: []spec.File{
+			{1, "patch-2.7.6-avoid-set_file_attributes-sign-conversion-warnings.patch"},
+			{2, "patch-fc.patch"},
+			{4, `%{lua: print("left as is")}`},
+		},
+		Changelog: []spec.ChangelogEntry{
+			{"Mon Jan 27 2020", "Jane Doe <jane@example.com>", "1:2.7.6-12", []string{"- fix CVE-2019-13636", "- fix CVE-2019-13638"}},
+			{"Tue Jul 30 2019", "John Doe <john@example.com>", "1:2.7.6-11", []string{"- Rebuilt for %%dist"}},
+		},
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected %+v, got %+v", expected, s)
+	}
+	if s.NEVR() != "patch-1:2.7.6-12.fc31" {
+		t.Errorf("unexpected NEVR '%s'", s.NEVR())
+	}
+
+	// without any macros, e.g. on an EL branch
+	s, err = spec.Parse([]byte(patchSpec), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Release != "11" || s.Patches[1].Value != "patch-el.patch" {
+		t.Errorf("unexpected Release '%s' and Patch2 '%s'", s.Release, s.Patches[1].Value)
+	}
+}
+
+func TestParseMacros(t *testing.T) {
+	cases := []struct {
+		Version  string
+		Expected string
+	}{
+		{"%{undefined}", "%{undefined}"},
+		{"%undefined", "%undefined"},
+		{"1%{?undefined}", "1"},
+		{"%{!?undefined:2}", "2"},
+		{"%{?name:3}", "3"},
+		{"100%%", "100%"},
+		{"%{loop}", "%{loop}"},
+		{"%(echo 1)", "%(echo 1)"},
+		{"%{expand:%name}", "%{expand:%name}"},
+		{"%{lazy}", "x.2"},
+		{"%{eager}", "x.1"},
+	}
+
+	for _, c := range cases {
+		data := "%define loop %{loop}\n%define minor 1\n%define lazy x.%{minor}\n%global eager x.%{minor}\n%define minor 2\n" +
+			"Name: n\nVersion: " + c.Version + "\nRelease: 1\n"
+		s, err := spec.Parse([]byte(data), nil)
+		if err != nil {
+			t.Errorf("unable to parse Version '%s': %v", c.Version, err)
+			continue
+		}
+		if s.Version != c.Expected {
+			t.Errorf("expected Version '%s' to be '%s', got '%s'", c.Version, c.Expected, s.Version)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		"Version: 1\nRelease: 1\n":                        "no Name",
+		"Name: n\nRelease: 1\n":                           "no Version",
+		"Name: n\nVersion: 1\n%prep\n":                    "no Release",
+		"Name: n\n%description\nVersion: 1\nRelease: 1\n": "no Version",
+	} {
+		_, err := spec.Parse([]byte(data), nil)
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected '%s' for %q, got: %v", expected, data, err)
+		}
+	}
+
+	// each macro is 10 of the one before it, a billion laughs
+	data := "%define lol0 lol\n"
+	for i := 1; i < 10; i++ {
+		data += fmt.Sprintf("%%define lol%d %s\n", i, strings.Repeat(fmt.Sprintf("%%{lol%d}", i-1), 10))
+	}
+	data += "Name: n\nVersion: %{lol9}\nRelease: 1\n"
+	_, err := spec.Parse([]byte(data), nil)
+	if err == nil || err.Error() != "line 12: macros expand to more than 1048576 bytes" {
+		t.Errorf("expected the expansion of lol9 to be cut off, got: %v", err)
+	}
+}
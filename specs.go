@@ -0,0 +1,97 @@
+package rgm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmahler/rgm/spec"
+)
+
+// The spec of a local branch, see Mirror.Specs.
+type BranchSpec struct {
+	Branch string
+	Path   string     `json:",omitempty"` // e.g. SPECS/patch.spec
+	Spec   *spec.Spec `json:",omitempty"`
+	Error  string     `json:",omitempty"`
+}
+
+// Where the spec of an RPM is looked for on a branch, Fedora keeps
+// it at the top and CentOS under SPECS/.
+func specPaths(name string) []string {
+	return []string{name + ".spec", "SPECS/" + name + ".spec"}
+}
+
+// Find and parse the spec of a branch.
+func readBranchSpec(repo repository, bm branchMapping, name string) (BranchSpec, error) {
+	bs := BranchSpec{Branch: bm.local}
+
+	commit, err := repo.BranchTarget(bm.local, localBranch)
+	if err != nil {
+		return bs, err
+	}
+
+	for _, path := range specPaths(name) {
+		data, err := repo.ReadFile(commit, path)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return bs, fmt.Errorf("unable to read '%s' of '%s': %v", path, bm.local, err)
+		}
+
+		bs.Path = path
+		bs.Spec, err = spec.Parse(data, nil)
+		if err != nil {
+			bs.Error = fmt.Sprintf("%s: %v", path, err)
+		}
+		return bs, nil
+	}
+	bs.Error = "no spec"
+
+	return bs, nil
+}
+
+// The spec of each local branch, as of its last update, to compare
+// the versions the remotes ship.  The name of the spec is the Name of
+// the RPM on the remote (see RemoteConfig.Names) and the %{?dist} of
+// the Release is left out since it isn't known.
+//
+//	fedora/f31  patch.spec        patch-2.7.6-11
+//	centos/c7   SPECS/patch.spec  patch-2.7.1-12
+//
+// A branch without a spec, or with one that can't be parsed, has an
+// Error instead.
+func (m *Mirror) Specs() ([]BranchSpec, error) {
+	if err := m.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	rcs := m.remoteConfigs()
+	settings := make(map[string]*RemoteConfig)
+	for i := range rcs {
+		settings[rcs[i].Name] = &rcs[i]
+	}
+
+	branches, err := getExpectedLocalBranches(m.repo, rcs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get branches: %v", err)
+	}
+
+	var specs []BranchSpec
+	for _, bm := range branches {
+		name := m.Rpm
+		if rc, ok := settings[bm.remote]; ok {
+			name = rc.templateData(m.Rpm).Name
+		}
+
+		bs, err := readBranchSpec(m.repo, bm, name)
+		if errors.Is(err, errNotFound) {
+			continue // not created yet
+		}
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, bs)
+	}
+
+	return specs, nil
+}
@@ -0,0 +1,87 @@
+package rgm_test
+
+import (
+	"github.com/jmahler/rgm"
+	"path/filepath"
+	"testing"
+)
+
+func testSpec(name string, version string, release string) string {
+	return "Name: " + name + "\nVersion: " + version + "\nRelease: " + release + "%{?dist}\n\n%description\n"
+}
+
+func TestMirrorSpecs(t *testing.T) {
+	dir := t.TempDir()
+
+	rpm := "patch"
+	config := setupUpstream(t, dir, rpm, rgm.Config{
+		Origin: rgm.RemoteConfig{Name: "origin"},
+		Remotes: []rgm.RemoteConfig{
+			{Name: "fedora"},
+			{Name: "centos", Names: map[string]string{"patch": "gnu-patch"}},
+		},
+	})
+	fedora := filepath.Join(dir, rpm+".fedora")
+	pushFile(t, fedora, "f31", "patch.spec", testSpec("patch", "2.7.6", "11"))
+	pushFile(t, fedora, "f30", "patch.spec", "Name: patch\n")
+	pushFile(t, filepath.Join(dir, rpm+".centos"), "c7", "SPECS/gnu-patch.spec", testSpec("patch", "2.7.1", "12"))
+
+	path := filepath.Join(dir, "mirror")
+	_, err := rgm.RpmMirror(config, rpm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := rgm.LoadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := rgm.NewMirror(cfg, rpm, path, rgm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err = m.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs, err := m.Specs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		Path  string
+		NEVR  string
+		Error string
+	}{
+		"centos/c6":     {"", "", "no spec"},
+		"centos/c7":     {"SPECS/gnu-patch.spec", "patch-2.7.1-12", ""},
+		"fedora/f29":    {"", "", "no spec"},
+		"fedora/f30":    {"patch.spec", "", "patch.spec: no Version"},
+		"fedora/f31":    {"patch.spec", "patch-2.7.6-11", ""},
+		"centos/master": {"", "", "no spec"},
+		"fedora/master": {"", "", "no spec"},
+		"origin/master": {"", "", "no spec"},
+	}
+	for _, bs := range specs {
+		e, ok := expected[bs.Branch]
+		if !ok {
+			t.Errorf("unexpected branch '%s'", bs.Branch)
+			continue
+		}
+		delete(expected, bs.Branch)
+
+		nevr := ""
+		if bs.Spec != nil {
+			nevr = bs.Spec.NEVR()
+		}
+		if bs.Path != e.Path || nevr != e.NEVR || bs.Error != e.Error {
+			t.Errorf("expected %+v for '%s', got '%s' '%s' '%s'", e, bs.Branch, bs.Path, nevr, bs.Error)
+		}
+	}
+	for branch := range expected {
+		t.Errorf("no spec for '%s'", branch)
+	}
+}
@@ -0,0 +1,263 @@
+package rgm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A problem with a config, at the JSON path of the setting.
+//
+//	config.json: Remotes[1].Name: 'fedora' is already the name of Remotes[0]
+type ConfigError struct {
+	// The file the setting came from, if it is known.
+	File    string
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.File == "" {
+		return e.Path + ": " + e.Message
+	}
+
+	return e.File + ": " + e.Path + ": " + e.Message
+}
+
+// All the problems with a config, one per line.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (errs *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check a config (template) for problems, such as remotes without a
+// name, two remotes with the same name or a URL template that doesn't
+// parse.  All of them are reported, as ConfigErrors.
+func (cfg *Config) Validate() error {
+	var errs ConfigErrors
+
+	names := make(map[string]string)
+	if cfg.Origin.Name != "origin" {
+		// clone always names its remote origin
+		names["origin"] = "the remote of the clone"
+	}
+	validateRemote(&errs, "Origin", &cfg.Origin, names)
+	for i := range cfg.Remotes {
+		validateRemote(&errs, fmt.Sprintf("Remotes[%d]", i), &cfg.Remotes[i], names)
+	}
+
+	switch cfg.Prune {
+	case PruneNone, PruneDelete, PruneArchive:
+	default:
+		errs.add("Prune", "unknown policy '%s', expected \"%s\" or \"%s\"", cfg.Prune, PruneDelete, PruneArchive)
+	}
+	switch cfg.Diverged {
+	case "", DivergedSkip, DivergedReset:
+	default:
+		errs.add("Diverged", "unknown policy '%s', expected \"%s\" or \"%s\"", cfg.Diverged, DivergedSkip, DivergedReset)
+	}
+
+	validateReleases(&errs, cfg.Releases, names)
+
+	validateRetry(&errs, "Retry", &cfg.Retry)
+
+	if _, err := getBackend(cfg.Backend); err != nil {
+		errs.add("Backend", "%v, expected one of %s", err, strings.Join(Backends(), ", "))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// The characters that git doesn't allow in a ref name, the name of
+// a remote is a part of the branch and tag names.
+const badRefChars = " \t~^:?*[\\"
+
+// Whether a (local) branch name is one that git allows.
+func validBranchName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, badRefChars) && !strings.Contains(name, "..") &&
+		!strings.Contains(name, "//") && !strings.Contains(name, "@{") &&
+		!strings.HasPrefix(name, "/") && !strings.HasSuffix(name, "/") &&
+		!strings.HasPrefix(name, "-") && !strings.HasSuffix(name, ".") &&
+		!strings.HasSuffix(name, ".lock") && !strings.Contains(name, "/.") && !strings.HasPrefix(name, ".")
+}
+
+func validateRemote(errs *ConfigErrors, path string, rc *RemoteConfig, names map[string]string) {
+	switch {
+	case rc.Name == "":
+		errs.add(path+".Name", "is empty")
+	case strings.Contains(rc.Name, "/"):
+		// the branches are named <remote>/<branch>
+		errs.add(path+".Name", "'%s' contains a '/'", rc.Name)
+	case strings.ContainsAny(rc.Name, badRefChars) || strings.Contains(rc.Name, "..") ||
+		strings.HasPrefix(rc.Name, ".") || strings.HasPrefix(rc.Name, "-"):
+		errs.add(path+".Name", "'%s' isn't a valid git remote name", rc.Name)
+	case names[rc.Name] != "":
+		errs.add(path+".Name", "'%s' is already the name of %s", rc.Name, names[rc.Name])
+	default:
+		names[rc.Name] = path
+	}
+
+	if len(rc.CandidateURLs()) == 0 {
+		errs.add(path, "has no URL or URLs")
+	}
+	if rc.URL != "" {
+		if _, err := parseTemplate(rc.URL); err != nil {
+			errs.add(path+".URL", "%v", err)
+		}
+	}
+	for i, url := range rc.URLs {
+		if _, err := parseTemplate(url); err != nil {
+			errs.add(fmt.Sprintf("%s.URLs[%d]", path, i), "%v", err)
+		}
+	}
+
+	for i, pattern := range rc.IncludeBranches {
+		if _, err := parseBranchPattern(pattern); err != nil {
+			errs.add(fmt.Sprintf("%s.IncludeBranches[%d]", path, i), "%v", err)
+		}
+	}
+	for i, pattern := range rc.ExcludeBranches {
+		if _, err := parseBranchPattern(pattern); err != nil {
+			errs.add(fmt.Sprintf("%s.ExcludeBranches[%d]", path, i), "%v", err)
+		}
+	}
+
+	if rc.BranchName != "" {
+		if _, err := parseTemplate(rc.BranchName); err != nil {
+			errs.add(path+".BranchName", "%v", err)
+		}
+	}
+
+	if rc.Lookaside != "" {
+		if _, err := parseTemplate(rc.Lookaside); err != nil {
+			errs.add(path+".Lookaside", "%v", err)
+		}
+	}
+
+	if rc.Timeout < 0 {
+		errs.add(path+".Timeout", "is negative")
+	}
+	if rc.Retry != nil {
+		validateRetry(errs, path+".Retry", rc.Retry)
+	}
+}
+
+// The releases and their aliases are each a part of a ref name, the
+// aliases are of the branches of known remotes.
+func validateReleases(errs *ConfigErrors, releases map[string]map[string]string, names map[string]string) {
+	release_names := make([]string, 0, len(releases))
+	for release := range releases {
+		release_names = append(release_names, release)
+	}
+	sort.Strings(release_names)
+
+	for _, release := range release_names {
+		path := fmt.Sprintf("Releases.%s", release)
+		if !validBranchName(release) || strings.Contains(release, "/") {
+			errs.add(path, "'%s' isn't a valid release name", release)
+		}
+		for _, alias := range sortedKeys(releases[release]) {
+			alias_path := path + "." + alias
+			if !validBranchName(alias) || strings.Contains(alias, "/") {
+				errs.add(alias_path, "'%s' isn't a valid alias name", alias)
+			}
+			tracking := releases[release][alias]
+			parts := strings.SplitN(tracking, "/", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				errs.add(alias_path, "'%s' isn't a <remote>/<branch>", tracking)
+			} else if names[parts[0]] == "" {
+				errs.add(alias_path, "'%s' isn't a remote", parts[0])
+			}
+		}
+	}
+}
+
+func validateRetry(errs *ConfigErrors, path string, rc *RetryConfig) {
+	if rc.Retries < 0 {
+		errs.add(path+".Retries", "is negative")
+	}
+	if rc.Backoff < 0 {
+		errs.add(path+".Backoff", "is negative")
+	}
+	if rc.MaxBackoff < 0 {
+		errs.add(path+".MaxBackoff", "is negative")
+	}
+}
+
+// Find the settings in a JSON config that aren't in the Config, which
+// json.Unmarshal silently ignores (e.g. a misspelled "Remote").
+func checkKeys(errs *ConfigErrors, path string, value interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		// a map (e.g. Names) can have any keys
+		if typ.Kind() != reflect.Struct {
+			return
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			key_path := key
+			if path != "" {
+				key_path = path + "." + key
+			}
+			field, ok := lookupField(typ, key)
+			if !ok {
+				errs.add(key_path, "unknown setting")
+				continue
+			}
+			checkKeys(errs, key_path, value[key], field.Type)
+		}
+	case []interface{}:
+		if typ.Kind() != reflect.Slice {
+			return
+		}
+		for i, elem := range value {
+			checkKeys(errs, fmt.Sprintf("%s[%d]", path, i), elem, typ.Elem())
+		}
+	}
+}
+
+// Find the field of a struct for a JSON key, the way json.Unmarshal
+// does (the case doesn't matter).
+func lookupField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,72 @@
+package rgm_test
+
+import (
+	"errors"
+	"github.com/jmahler/rgm"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	_, err := rgm.LoadConfig("testdata/config_invalid.json")
+	if err == nil {
+		t.Fatalf("expected testdata/config_invalid.json to be invalid")
+	}
+
+	var errs rgm.ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors: %v", err)
+	}
+
+	expected := []string{
+		"Remote: unknown setting",
+		"Remotes[1].Timout: unknown setting",
+		"Remotes[0].ExcludeBranches[0]: bad glob 'f[2'",
+		"Remotes[1].Name: 'fedora' is already the name of Remotes[0]",
+		"Remotes[2].Name: 'upstream' is already the name of Origin",
+		"Remotes[2].URLs[0]: unable to parse template",
+		"Remotes[3].Name: 'centos/c7' contains a '/'",
+		"Remotes[3].BranchName: unable to parse template",
+		"Remotes[3].Retry.Retries: is negative",
+		"Remotes[4].Name: is empty",
+		"Remotes[4]: has no URL or URLs",
+		"Remotes[5].Name: 'origin' is already the name of the remote of the clone",
+		"Prune: unknown policy 'remove'",
+		"Releases.el8.centos: 'rhel' isn't a remote",
+		"Releases.el8.fedora-epel: 'epel8' isn't a <remote>/<branch>",
+		"Backend: unknown backend 'cvs'",
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d problems, got %d:\n%v", len(expected), len(errs), errs)
+	}
+	for i, e := range errs {
+		if e.File != "testdata/config_invalid.json" {
+			t.Errorf("expected the file of '%v'", e)
+		}
+		if i < len(expected) && !strings.HasPrefix(e.Path+": "+e.Message, expected[i]) {
+			t.Errorf("expected '%s', got '%s'", expected[i], e.Error())
+		}
+	}
+}
+
+func TestValidateOK(t *testing.T) {
+	for _, config := range []string{"testdata/config.json", "testdata/config_urls.json"} {
+		cfg, err := rgm.LoadConfig(config)
+		if err != nil {
+			t.Fatalf("'%s' should be valid: %v", config, err)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("'%s' should be valid: %v", config, err)
+		}
+	}
+
+	// a config made in Go is checked when it is used
+	cfg := rgm.Config{
+		Origin:  rgm.RemoteConfig{Name: "origin", URL: "testdata/{{.RPM}}.origin"},
+		Remotes: []rgm.RemoteConfig{{Name: "origin", URL: "testdata/{{.RPM}}.fedora"}},
+	}
+	_, err := rgm.NewMirror(cfg, "patch", t.TempDir(), rgm.Options{})
+	if err == nil || !strings.Contains(err.Error(), "Remotes[0].Name") {
+		t.Errorf("expected the duplicate remote to fail: %v", err)
+	}
+}